@@ -0,0 +1,117 @@
+package analytics
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"planarcomputer/pss-fs/config"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+var (
+	secret           []byte
+	visitDedupWindow time.Duration
+	visitors         *visitorCache
+	events           *writer
+	rollups          *rollupJob
+	privacy          *anonymizer
+)
+
+// Initialize configures analytics recording and starts the background writer
+func Initialize(cfg *config.Config) {
+	secret = []byte(cfg.Analytics.Secret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			logging.Fatal("Failed to generate analytics secret", "error", err)
+		}
+		slog.Warn("ANALYTICS_SECRET is not set, visitor fingerprints will reset on restart")
+	}
+
+	privacy = newAnonymizer(cfg.Analytics)
+	countThreshold = cfg.Analytics.DownloadCountThreshold
+	botUserAgents = compileBotUserAgents(cfg.Analytics.BotUserAgents)
+	visitDedupWindow = cfg.Analytics.VisitDedupWindow
+	visitors = newVisitorCache(visitDedupWindow, maxCachedVisitors)
+	events = newWriter(cfg.Analytics.QueueSize, cfg.Analytics.BatchSize, cfg.Analytics.FlushInterval)
+	rollups = newRollupJob(cfg.Analytics.RollupInterval, cfg.Analytics.RetentionDays, cfg.Analytics.RetentionKeepRollups)
+}
+
+// Close stops accepting events, flushes everything still queued and stops the rollup job
+func Close(ctx context.Context) error {
+	if events != nil {
+		if err := events.close(ctx); err != nil {
+			return err
+		}
+	}
+	if rollups != nil {
+		if err := rollups.close(ctx); err != nil {
+			return fmt.Errorf("analytics rollup refresh still running: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetStats returns the analytics pipeline's counters
+func GetStats() Stats {
+	if events == nil {
+		return Stats{}
+	}
+	return events.stats()
+}
+
+// VisitorFingerprint identifies a visitor to a share without storing anything reversible.
+// It is keyed per share so the same visitor can't be correlated across shares.
+func VisitorFingerprint(shareID uuid.UUID, ip, userAgent string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\x00%s\x00%s", shareID, ip, userAgent)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RecordVisit queues a visit to a share and a view count increment, unless the same visitor
+// was already counted within the dedup window. It reports whether the visit counted.
+func RecordVisit(c *fiber.Ctx, shareID uuid.UUID) (bool, error) {
+	now := time.Now()
+	ip := utils.ClientIP(c)
+	fingerprint := VisitorFingerprint(shareID, ip, c.Get("User-Agent"))
+
+	if visitDedupWindow > 0 {
+		if visitors.seen(fingerprint, now) {
+			return false, nil
+		}
+		var recent int64
+		result := database.DB.WithContext(c.UserContext()).Model(&models.PsVisitAnalytics{}).
+			Where("share_id = ? AND visitor_hash = ? AND timestamp > ?", shareID, fingerprint, now.Add(-visitDedupWindow)).
+			Count(&recent)
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if recent > 0 {
+			return false, nil
+		}
+		visitors.add(fingerprint, now)
+	}
+
+	events.enqueue(event{visit: &models.PsVisitAnalytics{
+		ID:          uuid.New(),
+		ShareId:     shareID,
+		Timestamp:   now,
+		IpAddress:   utils.GetStringPtr(ip),
+		UserAgent:   utils.GetStringPtr(utils.TruncateString(c.Get("User-Agent"), 512)),
+		Referrer:    utils.GetStringPtr(utils.TruncateString(c.Get("Referer"), 512)),
+		VisitorHash: &fingerprint,
+	}})
+	return true, nil
+}
@@ -0,0 +1,71 @@
+package analytics
+
+import (
+	"io"
+)
+
+// ArchiveDownload tracks the files of an archive sent in one response, each recorded as its own
+// download and counted by how much of its span of the archive was sent
+type ArchiveDownload struct {
+	parts []archivePart
+}
+
+type archivePart struct {
+	download *Download
+	offset   int64
+}
+
+// Add tracks a file whose download covers bytes [offset, offset+size) of the archive, where size
+// is the one d was started with. A nil Download (a HEAD request or a bot) is ignored.
+func (a *ArchiveDownload) Add(d *Download, offset int64) {
+	if d != nil {
+		a.parts = append(a.parts, archivePart{download: d, offset: offset})
+	}
+}
+
+// Track wraps the body of a response sending length bytes of the archive starting at offset, and
+// records the files it overlaps once the body is closed
+func (a *ArchiveDownload) Track(r io.ReadCloser, offset, length int64) io.ReadCloser {
+	if len(a.parts) == 0 {
+		return r
+	}
+	return &trackedArchive{ReadCloser: r, parts: a.parts, start: offset, pos: offset, end: offset + length}
+}
+
+// trackedArchive attributes the bytes read from a response body to the files they belong to
+type trackedArchive struct {
+	io.ReadCloser
+	parts           []archivePart
+	start, pos, end int64
+}
+
+func (b *trackedArchive) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	for _, part := range b.parts {
+		if sent := overlap(b.pos, b.pos+int64(n), part.offset, part.offset+part.download.size); sent > 0 {
+			part.download.sent.Add(sent)
+		}
+	}
+	b.pos += int64(n)
+	return n, err
+}
+
+// Close records every file the response covered, files outside a requested range aren't recorded
+func (b *trackedArchive) Close() error {
+	err := b.ReadCloser.Close()
+	for _, part := range b.parts {
+		size := part.download.size
+		if length := overlap(b.start, b.end, part.offset, part.offset+size); length > 0 {
+			part.download.finish(length)
+		} else if size == 0 && part.offset >= b.start && part.offset < b.end {
+			// Empty files have no bytes to overlap, they are covered when their entry is
+			part.download.finish(0)
+		}
+	}
+	return err
+}
+
+// overlap returns how many bytes [start, end) and [from, to) have in common
+func overlap(start, end, from, to int64) int64 {
+	return max(min(end, to)-max(start, from), 0)
+}
@@ -0,0 +1,136 @@
+package analytics
+
+import (
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Download statuses stored on download analytics rows
+const (
+	DownloadCompleted  = "completed"  // every requested byte was sent
+	DownloadPartial    = "partial"    // enough was sent to count, but the transfer was cut short
+	DownloadIncomplete = "incomplete" // too little was sent to count, e.g. an aborted transfer or range probe
+)
+
+// defaultBotUserAgents match crawlers and link-preview fetchers, case-insensitively
+var defaultBotUserAgents = []string{
+	"bot", "crawler", "spider", "slurp", "preview", "facebookexternalhit", "embedly",
+	"whatsapp", "skypeuripreview", "bitlybot", "vkshare", "qwantify", "outbrain", "pinterest",
+}
+
+var (
+	countThreshold float64
+	botUserAgents  *regexp.Regexp
+)
+
+// isBot reports whether a user agent belongs to a crawler or link-preview fetcher
+func isBot(userAgent string) bool {
+	return botUserAgents != nil && botUserAgents.MatchString(userAgent)
+}
+
+func compileBotUserAgents(extra []string) *regexp.Regexp {
+	patterns := make([]string, 0, len(defaultBotUserAgents)+len(extra))
+	for _, pattern := range append(defaultBotUserAgents, extra...) {
+		patterns = append(patterns, regexp.QuoteMeta(strings.ToLower(pattern)))
+	}
+	return regexp.MustCompile("(?i)" + strings.Join(patterns, "|"))
+}
+
+// Download tracks how much of a share or file a response actually delivers. It is recorded
+// when the response body is closed, after the transfer finished or was cut short.
+type Download struct {
+	row  models.PsDownloadAnalytics
+	size int64
+	sent atomic.Int64
+	once sync.Once
+}
+
+// StartDownload begins tracking a download of size bytes, of a share or a single file in it.
+// HEAD requests and bots aren't tracked, for which it returns nil.
+func StartDownload(c *fiber.Ctx, shareID uuid.UUID, fileID *uuid.UUID, size int64) *Download {
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	if c.Method() == fiber.MethodHead || isBot(userAgent) {
+		return nil
+	}
+
+	// The request context is recycled once the handler returns, so everything is copied now
+	return &Download{
+		row: models.PsDownloadAnalytics{
+			ID:        uuid.New(),
+			ShareId:   shareID,
+			FileId:    fileID,
+			Timestamp: time.Now(),
+			IpAddress: utils.GetStringPtr(utils.ClientIP(c)),
+			UserAgent: utils.GetStringPtr(utils.TruncateString(userAgent, 512)),
+		},
+		size: size,
+	}
+}
+
+// Tracker records the downloads delivered by a response body
+type Tracker interface {
+	// Track wraps a body sending length bytes starting at offset of the download
+	Track(r io.ReadCloser, offset, length int64) io.ReadCloser
+}
+
+// Track wraps the body of a response sending length bytes of the download, and records the
+// download once the body is closed. A nil Download returns r unchanged.
+func (d *Download) Track(r io.ReadCloser, offset, length int64) io.ReadCloser {
+	if d == nil {
+		return r
+	}
+	return &trackedBody{ReadCloser: r, download: d, length: length}
+}
+
+// finish records the download with how much of it was sent
+func (d *Download) finish(length int64) {
+	d.once.Do(func() {
+		sent := d.sent.Load()
+		status := DownloadIncomplete
+		switch {
+		case float64(sent) < countThreshold*float64(d.size):
+		case sent >= length:
+			status = DownloadCompleted
+		default:
+			status = DownloadPartial
+		}
+
+		d.row.BytesSent = &sent
+		d.row.Status = &status
+		events.enqueue(event{download: &d.row})
+	})
+}
+
+// counted reports whether a download row counts towards a share's downloads
+func counted(row *models.PsDownloadAnalytics) bool {
+	return row.Status == nil || *row.Status != DownloadIncomplete
+}
+
+// trackedBody counts the bytes read from a response body, which fasthttp reads as it writes
+type trackedBody struct {
+	io.ReadCloser
+	download *Download
+	length   int64
+}
+
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.download.sent.Add(int64(n))
+	return n, err
+}
+
+func (b *trackedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.download.finish(b.length)
+	return err
+}
@@ -0,0 +1,86 @@
+package analytics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"planarcomputer/pss-fs/config"
+	"planarcomputer/pss-fs/utils"
+)
+
+// IP storage modes
+const (
+	IPModeFull     = "full"
+	IPModeTruncate = "truncate"
+	IPModeHash     = "hash"
+	IPModeNone     = "none"
+)
+
+// hashedIPLength keeps hashed addresses within the ip_address column
+const hashedIPLength = 32
+
+// anonymizer reduces what is stored about a visitor before a row is written
+type anonymizer struct {
+	ipMode          string
+	ipv4Mask        net.IPMask
+	ipv6Mask        net.IPMask
+	storeUserAgents bool
+}
+
+func newAnonymizer(cfg config.AnalyticsConfig) *anonymizer {
+	return &anonymizer{
+		ipMode:          cfg.IPMode,
+		ipv4Mask:        net.CIDRMask(cfg.IPv4Prefix, 32),
+		ipv6Mask:        net.CIDRMask(cfg.IPv6Prefix, 128),
+		storeUserAgents: cfg.StoreUserAgents,
+	}
+}
+
+// AnonymizeIP returns a client address as ANALYTICS_IP_MODE says it may be stored, nil if it
+// shouldn't be stored at all. Audit records store addresses the same way as analytics.
+func AnonymizeIP(address string) *string {
+	if privacy == nil {
+		return utils.GetStringPtr(address)
+	}
+	return privacy.ip(utils.GetStringPtr(address))
+}
+
+// ip returns the address as it should be stored, nil if it shouldn't be stored at all
+func (a *anonymizer) ip(address *string) *string {
+	if address == nil {
+		return nil
+	}
+
+	switch a.ipMode {
+	case IPModeNone:
+		return nil
+	case IPModeHash:
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(*address))
+		hashed := hex.EncodeToString(mac.Sum(nil))[:hashedIPLength]
+		return &hashed
+	case IPModeTruncate:
+		ip := net.ParseIP(*address)
+		if ip == nil {
+			return nil
+		}
+		var truncated string
+		if v4 := ip.To4(); v4 != nil {
+			truncated = v4.Mask(a.ipv4Mask).String()
+		} else {
+			truncated = ip.Mask(a.ipv6Mask).String()
+		}
+		return &truncated
+	}
+	return address
+}
+
+// userAgent returns the user agent as it should be stored
+func (a *anonymizer) userAgent(userAgent *string) *string {
+	if !a.storeUserAgents {
+		return nil
+	}
+	return userAgent
+}
@@ -0,0 +1,41 @@
+package analytics
+
+import (
+	"testing"
+
+	"planarcomputer/pss-fs/config"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	secret = []byte("test")
+	defer func() { privacy = nil }()
+
+	tests := []struct {
+		mode    string
+		address string
+		want    string // "" for nil
+	}{
+		{IPModeFull, "203.0.113.7", "203.0.113.7"},
+		{IPModeTruncate, "203.0.113.7", "203.0.113.0"},
+		{IPModeTruncate, "2001:db8:1:2::7", "2001:db8:1::"},
+		{IPModeTruncate, "not an address", ""},
+		{IPModeNone, "203.0.113.7", ""},
+		{IPModeFull, "", ""},
+	}
+	for _, tt := range tests {
+		privacy = newAnonymizer(config.AnalyticsConfig{IPMode: tt.mode, IPv4Prefix: 24, IPv6Prefix: 48})
+		got := AnonymizeIP(tt.address)
+		if (got == nil) != (tt.want == "") || (got != nil && *got != tt.want) {
+			t.Errorf("%s: AnonymizeIP(%q) = %v, want %q", tt.mode, tt.address, got, tt.want)
+		}
+	}
+
+	privacy = newAnonymizer(config.AnalyticsConfig{IPMode: IPModeHash})
+	hashed := AnonymizeIP("203.0.113.7")
+	if hashed == nil || len(*hashed) != hashedIPLength || *hashed == "203.0.113.7" {
+		t.Errorf("hash: AnonymizeIP = %v, want a %d character hash", hashed, hashedIPLength)
+	}
+	if again := AnonymizeIP("203.0.113.7"); again == nil || *again != *hashed {
+		t.Errorf("hash: AnonymizeIP isn't stable, got %v and %v", hashed, again)
+	}
+}
@@ -0,0 +1,229 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"planarcomputer/pss-fs/database"
+
+	"github.com/google/uuid"
+)
+
+// Bucket sizes for a report's time series
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+	BucketWeek = "week"
+)
+
+// maxReportBuckets caps the length of a report's time series
+const maxReportBuckets = 1000
+
+// ErrInvalidBucket is returned for a bucket size other than hour, day or week
+var ErrInvalidBucket = errors.New("bucket must be hour, day or week")
+
+// ErrTooManyBuckets is returned when a report's range would need more than maxReportBuckets buckets
+var ErrTooManyBuckets = errors.New("time range too large for bucket size")
+
+// Point is the activity of a share in one bucket. Unique visitors are distinct within the
+// bucket, weekly buckets add up the daily counts.
+type Point struct {
+	Bucket         time.Time `json:"bucket"`
+	Downloads      int64     `json:"downloads"`
+	Visits         int64     `json:"visits"`
+	UniqueVisitors int64     `json:"unique_visitors"`
+}
+
+// TopFile is a file ranked by downloads
+type TopFile struct {
+	FileId    uuid.UUID `json:"file_id"`
+	FileName  *string   `json:"file_name"`
+	Downloads int64     `json:"downloads"`
+}
+
+// TopReferrer is a referring host ranked by visits
+type TopReferrer struct {
+	Host           string `json:"host"`
+	Visits         int64  `json:"visits"`
+	UniqueVisitors int64  `json:"unique_visitors"`
+}
+
+// CountryCount is a share's activity from one country
+type CountryCount struct {
+	Country   string `json:"country"`
+	Downloads int64  `json:"downloads"`
+	Visits    int64  `json:"visits"`
+}
+
+// Report summarises a share's analytics over a time range, read from the rollup tables except
+// for the unique visitors total, which is counted from the raw visits still retained. The
+// breakdowns cover every day the range touches.
+type Report struct {
+	ShareId        uuid.UUID      `json:"share_id"`
+	From           time.Time      `json:"from"`
+	To             time.Time      `json:"to"`
+	Bucket         string         `json:"bucket"`
+	Downloads      int64          `json:"downloads"`
+	Visits         int64          `json:"visits"`
+	UniqueVisitors int64          `json:"unique_visitors"`
+	Series         []Point        `json:"series"`
+	TopFiles       []TopFile      `json:"top_files"`
+	TopReferrers   []TopReferrer  `json:"top_referrers"`
+	Countries      []CountryCount `json:"countries"`
+	RefreshedAt    *time.Time     `json:"refreshed_at"`
+}
+
+// ShareReport builds a report of a share's activity in [from, to), with series buckets of the
+// given size and at most limit top files and referrers
+func ShareReport(ctx context.Context, shareID uuid.UUID, from, to time.Time, bucket string, limit int) (*Report, error) {
+	step, err := bucketStep(bucket)
+	if err != nil {
+		return nil, err
+	}
+	start := truncateBucket(from.UTC(), bucket)
+	if to.Sub(start)/step > maxReportBuckets {
+		return nil, ErrTooManyBuckets
+	}
+
+	report := &Report{
+		ShareId:      shareID,
+		From:         start,
+		To:           to.UTC(),
+		Bucket:       bucket,
+		TopFiles:     []TopFile{},
+		TopReferrers: []TopReferrer{},
+		Countries:    []CountryCount{},
+	}
+	if rollups != nil {
+		if refreshed := rollups.lastRefresh(); !refreshed.IsZero() {
+			report.RefreshedAt = &refreshed
+		}
+	}
+
+	// Hourly buckets come from the hourly rollup, everything else from the daily totals
+	var points []Point
+	switch bucket {
+	case BucketHour:
+		err = database.DB.WithContext(ctx).Raw(`
+			SELECT bucket, downloads, visits, unique_visitors FROM ps_analytics_hourly
+			WHERE share_id = ? AND bucket >= ? AND bucket < ?
+		`, shareID, start, to).Scan(&points).Error
+	default:
+		err = database.DB.WithContext(ctx).Raw(`
+			SELECT date_trunc(?, day::timestamp) AT TIME ZONE 'UTC' AS bucket,
+				SUM(downloads) AS downloads, SUM(visits) AS visits, SUM(unique_visitors) AS unique_visitors
+			FROM ps_analytics_daily
+			WHERE share_id = ? AND dimension = 'total' AND day >= ?::date AND day < ?::date
+			GROUP BY 1
+		`, bucket, shareID, start.Format(time.DateOnly), endDay(to)).Scan(&points).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Series = fillSeries(points, start, to, bucket)
+	for _, point := range report.Series {
+		report.Downloads += point.Downloads
+		report.Visits += point.Visits
+	}
+
+	// Visitors seen in several buckets count once, so the total comes from the raw visits
+	if err := database.DB.WithContext(ctx).Raw(`
+		SELECT COUNT(DISTINCT visitor_hash) FROM ps_visit_analytics
+		WHERE share_id = ? AND timestamp >= ? AND timestamp < ?
+	`, shareID, start, to).Scan(&report.UniqueVisitors).Error; err != nil {
+		return nil, err
+	}
+
+	// Breakdowns are daily, so they span whole days
+	firstDay, lastDay := start.Format(time.DateOnly), endDay(to)
+
+	if err := database.DB.WithContext(ctx).Raw(`
+		SELECT d.value::uuid AS file_id, f.file_name, SUM(d.downloads) AS downloads
+		FROM ps_analytics_daily AS d
+		LEFT JOIN ps_files AS f ON f.id = d.value::uuid
+		WHERE d.share_id = ? AND d.dimension = 'file' AND d.day >= ?::date AND d.day < ?::date
+		GROUP BY d.value, f.file_name
+		ORDER BY downloads DESC
+		LIMIT ?
+	`, shareID, firstDay, lastDay, limit).Scan(&report.TopFiles).Error; err != nil {
+		return nil, err
+	}
+
+	if err := database.DB.WithContext(ctx).Raw(`
+		SELECT value AS host, SUM(visits) AS visits, SUM(unique_visitors) AS unique_visitors
+		FROM ps_analytics_daily
+		WHERE share_id = ? AND dimension = 'referrer' AND day >= ?::date AND day < ?::date
+		GROUP BY value
+		ORDER BY visits DESC
+		LIMIT ?
+	`, shareID, firstDay, lastDay, limit).Scan(&report.TopReferrers).Error; err != nil {
+		return nil, err
+	}
+
+	if err := database.DB.WithContext(ctx).Raw(`
+		SELECT value AS country, SUM(downloads) AS downloads, SUM(visits) AS visits
+		FROM ps_analytics_daily
+		WHERE share_id = ? AND dimension = 'country' AND day >= ?::date AND day < ?::date
+		GROUP BY value
+		ORDER BY downloads + visits DESC
+	`, shareID, firstDay, lastDay).Scan(&report.Countries).Error; err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// endDay returns the UTC date after the last day [.., to) touches, as an exclusive bound for days
+func endDay(to time.Time) string {
+	day := to.UTC().Truncate(24 * time.Hour)
+	if day.Before(to) {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day.Format(time.DateOnly)
+}
+
+func bucketStep(bucket string) (time.Duration, error) {
+	switch bucket {
+	case BucketHour:
+		return time.Hour, nil
+	case BucketDay:
+		return 24 * time.Hour, nil
+	case BucketWeek:
+		return 7 * 24 * time.Hour, nil
+	}
+	return 0, ErrInvalidBucket
+}
+
+// truncateBucket returns the start of the bucket containing t. Weeks start on Monday, as
+// with Postgres' date_trunc.
+func truncateBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case BucketHour:
+		return t.Truncate(time.Hour)
+	case BucketWeek:
+		day := t.Truncate(24 * time.Hour)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+	return t.Truncate(24 * time.Hour)
+}
+
+// fillSeries returns a point for every bucket in [start, to), with zeros where there was no activity
+func fillSeries(points []Point, start, to time.Time, bucket string) []Point {
+	byBucket := make(map[time.Time]Point, len(points))
+	for _, point := range points {
+		byBucket[point.Bucket.UTC()] = point
+	}
+
+	step, _ := bucketStep(bucket)
+	series := make([]Point, 0, to.Sub(start)/step+1)
+	for at := start; at.Before(to); at = at.Add(step) {
+		point, ok := byBucket[at]
+		if !ok {
+			point = Point{}
+		}
+		point.Bucket = at
+		series = append(series, point)
+	}
+	return series
+}
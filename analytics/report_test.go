@@ -0,0 +1,61 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndDay(t *testing.T) {
+	tests := []struct {
+		to   time.Time
+		want string
+	}{
+		{time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC), "2026-03-04"},
+		{time.Date(2026, 3, 4, 0, 0, 1, 0, time.UTC), "2026-03-05"},
+		{time.Date(2026, 3, 4, 23, 59, 0, 0, time.UTC), "2026-03-05"},
+		// 22:00 in New York is already the next day in UTC
+		{time.Date(2026, 3, 4, 22, 0, 0, 0, time.FixedZone("EST", -5*3600)), "2026-03-06"},
+	}
+	for _, tt := range tests {
+		if got := endDay(tt.to); got != tt.want {
+			t.Errorf("endDay(%s) = %s, want %s", tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateBucket(t *testing.T) {
+	at := time.Date(2026, 3, 5, 13, 45, 0, 0, time.UTC) // a Thursday
+	tests := []struct {
+		bucket string
+		want   time.Time
+	}{
+		{BucketHour, time.Date(2026, 3, 5, 13, 0, 0, 0, time.UTC)},
+		{BucketDay, time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{BucketWeek, time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := truncateBucket(at, tt.bucket); !got.Equal(tt.want) {
+			t.Errorf("truncateBucket(%s) = %s, want %s", tt.bucket, got, tt.want)
+		}
+	}
+}
+
+func TestFillSeries(t *testing.T) {
+	start := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	// Buckets scanned from Postgres may come back in another zone
+	second := start.AddDate(0, 0, 1).In(time.FixedZone("CET", 3600))
+	points := []Point{{Bucket: second, Downloads: 2, Visits: 3}}
+
+	series := fillSeries(points, start, start.AddDate(0, 0, 3), BucketDay)
+	if len(series) != 3 {
+		t.Fatalf("%d points, want 3", len(series))
+	}
+	for i, point := range series {
+		if want := start.AddDate(0, 0, i); !point.Bucket.Equal(want) || point.Bucket.Location() != time.UTC {
+			t.Errorf("point %d bucket %s, want %s", i, point.Bucket, want)
+		}
+	}
+	if series[0].Downloads != 0 || series[1].Downloads != 2 || series[1].Visits != 3 || series[2].Visits != 0 {
+		t.Errorf("series %+v", series)
+	}
+}
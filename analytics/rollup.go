@@ -0,0 +1,238 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"planarcomputer/pss-fs/database"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// rollupOverlap is how far before the previous refresh buckets are rebuilt, so events that were
+// still queued or being written when it ran are picked up
+const rollupOverlap = time.Hour
+
+// rollupLockKey is the advisory lock serialising rollup refreshes and analytics deletions, across
+// instances, so a refresh never re-creates rollups from rows deleted while it ran
+const rollupLockKey = 0x70737366 // "pssf"
+
+// retentionBatchSize is how many expired rows are deleted per statement
+const retentionBatchSize = 10000
+
+// rollupJob periodically rebuilds the recent buckets of the rollup tables from the raw analytics,
+// then deletes raw rows past the retention period
+type rollupJob struct {
+	interval      time.Duration
+	retentionDays int
+	keepRollups   bool
+	stop          chan struct{}
+	done          chan struct{}
+
+	mu          sync.Mutex
+	refreshedAt time.Time
+}
+
+func newRollupJob(interval time.Duration, retentionDays int, keepRollups bool) *rollupJob {
+	r := &rollupJob{
+		interval:      interval,
+		retentionDays: retentionDays,
+		keepRollups:   keepRollups,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *rollupJob) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	// Catch up from wherever the rollups stopped, which is everything on the first start
+	since, err := rollupStart()
+	if err != nil {
+		slog.Error("Failed to find where analytics rollups stopped", "error", err)
+	}
+	for {
+		started := time.Now()
+		if err := refreshRollups(since); err != nil {
+			slog.Error("Failed to refresh analytics rollups", "error", err)
+		} else {
+			r.mu.Lock()
+			r.refreshedAt = started
+			r.mu.Unlock()
+			since = started.Add(-rollupOverlap)
+
+			// Expired rows are only deleted once they are safely rolled up
+			if r.retentionDays > 0 {
+				if err := applyRetention(started.AddDate(0, 0, -r.retentionDays), r.keepRollups); err != nil {
+					slog.Error("Failed to apply analytics retention", "error", err)
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// lastRefresh returns when the rollups were last rebuilt, zero if not yet
+func (r *rollupJob) lastRefresh() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refreshedAt
+}
+
+func (r *rollupJob) close(ctx context.Context) error {
+	close(r.stop)
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rollupStart returns the start of the last day already rolled up, or zero if there are no rollups
+func rollupStart() (time.Time, error) {
+	var latest *time.Time
+	if err := database.DB.Raw("SELECT MAX(day)::timestamp AT TIME ZONE 'UTC' FROM ps_analytics_daily").Scan(&latest).Error; err != nil || latest == nil {
+		return time.Time{}, err
+	}
+	return *latest, nil
+}
+
+// refreshRollups rebuilds every hourly bucket and daily row from since onwards. Downloads that
+// delivered too little to count are left out. Whole days are rebuilt so the daily breakdowns stay
+// complete, and rows are replaced rather than incremented so rebuilding is idempotent and reflects
+// deleted analytics. Days and hours are always UTC, whatever the session's time zone.
+func refreshRollups(since time.Time) error {
+	day := since.UTC().Truncate(24 * time.Hour)
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", rollupLockKey).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM ps_analytics_hourly WHERE bucket >= ?", day).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(`
+			INSERT INTO ps_analytics_hourly (share_id, bucket, downloads, visits, unique_visitors)
+			SELECT share_id, bucket, SUM(downloads), SUM(visits), SUM(unique_visitors)
+			FROM (
+				SELECT share_id, date_trunc('hour', timestamp AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS bucket,
+					COUNT(*) AS downloads, 0 AS visits, 0 AS unique_visitors
+				FROM ps_download_analytics WHERE timestamp >= @day AND status IS DISTINCT FROM 'incomplete' GROUP BY 1, 2
+				UNION ALL
+				SELECT share_id, date_trunc('hour', timestamp AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+					0, COUNT(*), COUNT(DISTINCT visitor_hash)
+				FROM ps_visit_analytics WHERE timestamp >= @day GROUP BY 1, 2
+			) AS events
+			GROUP BY share_id, bucket
+		`, map[string]interface{}{"day": day}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Exec("DELETE FROM ps_analytics_daily WHERE day >= ?::date", day.Format(time.DateOnly)).Error; err != nil {
+			return err
+		}
+		return tx.Exec(`
+			INSERT INTO ps_analytics_daily (share_id, day, dimension, value, downloads, visits, unique_visitors)
+			SELECT share_id, day, dimension, value, SUM(downloads), SUM(visits), SUM(unique_visitors)
+			FROM (
+				SELECT share_id, (timestamp AT TIME ZONE 'UTC')::date AS day, 'total' AS dimension, '' AS value,
+					COUNT(*) AS downloads, 0 AS visits, 0 AS unique_visitors
+				FROM ps_download_analytics WHERE timestamp >= @day AND status IS DISTINCT FROM 'incomplete' GROUP BY 1, 2
+				UNION ALL
+				SELECT share_id, (timestamp AT TIME ZONE 'UTC')::date, 'total', '', 0, COUNT(*), COUNT(DISTINCT visitor_hash)
+				FROM ps_visit_analytics WHERE timestamp >= @day GROUP BY 1, 2
+				UNION ALL
+				SELECT share_id, (timestamp AT TIME ZONE 'UTC')::date, 'file', file_id::text, COUNT(*), 0, 0
+				FROM ps_download_analytics WHERE timestamp >= @day AND status IS DISTINCT FROM 'incomplete' AND file_id IS NOT NULL GROUP BY 1, 2, 4
+				UNION ALL
+				SELECT share_id, (timestamp AT TIME ZONE 'UTC')::date, 'referrer', lower(substring(referrer FROM '^[A-Za-z][A-Za-z0-9+.-]*://([^/:?#]+)')),
+					0, COUNT(*), COUNT(DISTINCT visitor_hash)
+				FROM ps_visit_analytics WHERE timestamp >= @day AND referrer ~ '^[A-Za-z][A-Za-z0-9+.-]*://[^/:?#]+' GROUP BY 1, 2, 4
+				UNION ALL
+				SELECT share_id, (timestamp AT TIME ZONE 'UTC')::date, 'country', country, COUNT(*), 0, 0
+				FROM ps_download_analytics WHERE timestamp >= @day AND status IS DISTINCT FROM 'incomplete' AND country IS NOT NULL GROUP BY 1, 2, 4
+				UNION ALL
+				SELECT share_id, (timestamp AT TIME ZONE 'UTC')::date, 'country', country, 0, COUNT(*), COUNT(DISTINCT visitor_hash)
+				FROM ps_visit_analytics WHERE timestamp >= @day AND country IS NOT NULL GROUP BY 1, 2, 4
+			) AS events
+			GROUP BY share_id, day, dimension, value
+		`, map[string]interface{}{"day": day}).Error
+	})
+}
+
+// applyRetention deletes raw analytics rows from before the start of the cutoff's day, in batches
+// so the tables aren't locked for long. Rollups of those days are kept when keepRollups is set.
+func applyRetention(cutoff time.Time, keepRollups bool) error {
+	day := cutoff.UTC().Truncate(24 * time.Hour)
+
+	var deleted int64
+	for _, table := range []string{"ps_download_analytics", "ps_visit_analytics"} {
+		for {
+			result := database.DB.Exec(fmt.Sprintf(
+				"DELETE FROM %[1]s WHERE id IN (SELECT id FROM %[1]s WHERE timestamp < ? LIMIT ?)", table,
+			), day, retentionBatchSize)
+			if result.Error != nil {
+				return result.Error
+			}
+			deleted += result.RowsAffected
+			if result.RowsAffected < retentionBatchSize {
+				break
+			}
+		}
+	}
+
+	if !keepRollups {
+		if err := database.DB.Exec("DELETE FROM ps_analytics_hourly WHERE bucket < ?", day).Error; err != nil {
+			return err
+		}
+		if err := database.DB.Exec("DELETE FROM ps_analytics_daily WHERE day < ?::date", day.Format(time.DateOnly)).Error; err != nil {
+			return err
+		}
+	}
+
+	if deleted > 0 {
+		slog.Info("Deleted expired analytics rows", "rows", deleted, "before", day.Format(time.DateOnly))
+	}
+	return nil
+}
+
+// DeleteShareAnalytics deletes every analytics row and rollup of a share, returning how many raw
+// rows were deleted. The share's download and view counts are kept.
+func DeleteShareAnalytics(ctx context.Context, shareID uuid.UUID) (int64, error) {
+	var deleted int64
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", rollupLockKey).Error; err != nil {
+			return err
+		}
+		for _, table := range []string{"ps_download_analytics", "ps_visit_analytics"} {
+			result := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE share_id = ?", table), shareID)
+			if result.Error != nil {
+				return result.Error
+			}
+			deleted += result.RowsAffected
+		}
+		if err := tx.Exec("DELETE FROM ps_analytics_hourly WHERE share_id = ?", shareID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM ps_analytics_daily WHERE share_id = ?", shareID).Error; err != nil {
+			return err
+		}
+		return nil
+	})
+	return deleted, err
+}
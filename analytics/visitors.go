@@ -0,0 +1,70 @@
+package analytics
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// maxCachedVisitors bounds the visitor cache, evicting the least recently counted visitor first
+const maxCachedVisitors = 100000
+
+// visitorCache remembers the visitors this instance recently counted, so their repeat visits
+// within the window are skipped without touching the database, including while their visit is
+// still queued. A miss proves nothing, the database stays the authority.
+type visitorCache struct {
+	mu       sync.Mutex
+	window   time.Duration
+	capacity int
+	order    *list.List // of *cachedVisitor, most recently counted first
+	entries  map[string]*list.Element
+}
+
+type cachedVisitor struct {
+	fingerprint string
+	at          time.Time
+}
+
+func newVisitorCache(window time.Duration, capacity int) *visitorCache {
+	return &visitorCache{
+		window:   window,
+		capacity: max(capacity, 1),
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// seen reports whether fingerprint was counted by this instance within the window
+func (v *visitorCache) seen(fingerprint string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	elem, ok := v.entries[fingerprint]
+	if !ok {
+		return false
+	}
+	if now.Sub(elem.Value.(*cachedVisitor).at) > v.window {
+		v.order.Remove(elem)
+		delete(v.entries, fingerprint)
+		return false
+	}
+	return true
+}
+
+// add records that fingerprint was counted at now
+func (v *visitorCache) add(fingerprint string, now time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if elem, ok := v.entries[fingerprint]; ok {
+		elem.Value.(*cachedVisitor).at = now
+		v.order.MoveToFront(elem)
+		return
+	}
+	v.entries[fingerprint] = v.order.PushFront(&cachedVisitor{fingerprint: fingerprint, at: now})
+	for v.order.Len() > v.capacity {
+		oldest := v.order.Back()
+		v.order.Remove(oldest)
+		delete(v.entries, oldest.Value.(*cachedVisitor).fingerprint)
+	}
+}
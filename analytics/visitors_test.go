@@ -0,0 +1,36 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVisitorCache(t *testing.T) {
+	start := time.Now()
+	cache := newVisitorCache(time.Minute, 2)
+
+	if cache.seen("a", start) {
+		t.Fatal("empty cache has seen a")
+	}
+	cache.add("a", start)
+	cache.add("b", start)
+	if !cache.seen("a", start.Add(time.Minute)) {
+		t.Error("a not seen within the window")
+	}
+	if cache.seen("a", start.Add(time.Minute+time.Second)) {
+		t.Error("a still seen after the window")
+	}
+
+	// c evicts the least recently counted visitor, b
+	cache.add("a", start)
+	cache.add("c", start)
+	if cache.seen("b", start) {
+		t.Error("b not evicted")
+	}
+	if !cache.seen("a", start) || !cache.seen("c", start) {
+		t.Error("a or c evicted")
+	}
+	if len(cache.entries) != 2 || cache.order.Len() != 2 {
+		t.Errorf("%d entries, %d in order, want 2", len(cache.entries), cache.order.Len())
+	}
+}
@@ -0,0 +1,261 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/geoip"
+	"planarcomputer/pss-fs/models"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var tracer = otel.Tracer("planarcomputer/pss-fs/analytics")
+
+// enqueueTimeout is how long a request waits for room in a full queue before its event is dropped
+const enqueueTimeout = 5 * time.Millisecond
+
+// event is a single analytics row waiting to be written
+type event struct {
+	download *models.PsDownloadAnalytics
+	visit    *models.PsVisitAnalytics
+}
+
+// counters are the share counter increments accumulated in a batch
+type counters struct {
+	downloads int
+	views     int
+}
+
+// Stats describes the analytics pipeline
+type Stats struct {
+	Enqueued      uint64 // events accepted into the queue
+	Written       uint64 // events written to the database
+	Dropped       uint64 // events discarded because the queue stayed full
+	Failed        uint64 // events lost to database errors
+	Backpressure  uint64 // times a request found the queue full and had to wait
+	QueueDepth    int
+	QueueCapacity int
+}
+
+// writer drains the event queue into the database in batches
+type writer struct {
+	queue         chan event
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+
+	// mu guards closing the queue, so events arriving during shutdown are dropped rather than panicking
+	mu     sync.RWMutex
+	closed bool
+
+	enqueued     atomic.Uint64
+	written      atomic.Uint64
+	dropped      atomic.Uint64
+	failed       atomic.Uint64
+	backpressure atomic.Uint64
+}
+
+func newWriter(queueSize, batchSize int, flushInterval time.Duration) *writer {
+	w := &writer{
+		queue:         make(chan event, max(queueSize, 1)),
+		batchSize:     max(batchSize, 1),
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue adds an event without ever blocking a request for more than enqueueTimeout
+func (w *writer) enqueue(e event) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.dropped.Add(1)
+		return
+	}
+
+	select {
+	case w.queue <- e:
+		w.enqueued.Add(1)
+		return
+	default:
+	}
+
+	w.backpressure.Add(1)
+	timer := time.NewTimer(enqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case w.queue <- e:
+		w.enqueued.Add(1)
+	case <-timer.C:
+		if w.dropped.Add(1)%1000 == 1 {
+			slog.Warn("Analytics queue is full, dropping events", "dropped", w.dropped.Load())
+		}
+	}
+}
+
+func (w *writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]event, 0, w.batchSize)
+	for {
+		select {
+		case e, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes a batch of rows and applies the coalesced share counter increments
+func (w *writer) flush(batch []event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	// Batches are written outside any request, so each flush starts its own trace
+	ctx, span := tracer.Start(context.Background(), "analytics.flush", trace.WithAttributes(attribute.Int("pssfs.events", len(batch))))
+	defer span.End()
+
+	var downloads []models.PsDownloadAnalytics
+	var visits []models.PsVisitAnalytics
+	downloadCounts := make(map[uuid.UUID]*counters)
+	viewCounts := make(map[uuid.UUID]*counters)
+	for _, e := range batch {
+		// Locations are resolved here rather than on the request path, from the full
+		// address before it is anonymised for storage
+		switch {
+		case e.download != nil:
+			e.download.Country, e.download.City = locate(e.download.IpAddress)
+			e.download.IpAddress = privacy.ip(e.download.IpAddress)
+			e.download.UserAgent = privacy.userAgent(e.download.UserAgent)
+			downloads = append(downloads, *e.download)
+			if counted(e.download) {
+				increment(downloadCounts, e.download.ShareId).downloads++
+			}
+		case e.visit != nil:
+			e.visit.Country, e.visit.City = locate(e.visit.IpAddress)
+			e.visit.IpAddress = privacy.ip(e.visit.IpAddress)
+			e.visit.UserAgent = privacy.userAgent(e.visit.UserAgent)
+			visits = append(visits, *e.visit)
+			increment(viewCounts, e.visit.ShareId).views++
+		}
+	}
+
+	if len(downloads) > 0 {
+		w.write(ctx, "download", downloads, len(downloads), downloadCounts)
+	}
+	if len(visits) > 0 {
+		w.write(ctx, "visit", visits, len(visits), viewCounts)
+	}
+}
+
+// write inserts rows together with their share counter increments, in one transaction so the
+// counters only move for rows that were stored
+func (w *writer) write(ctx context.Context, kind string, rows interface{}, count int, increments map[uuid.UUID]*counters) {
+	err := database.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.CreateInBatches(rows, w.batchSize).Error; err != nil {
+			return err
+		}
+		return applyCounters(tx, increments)
+	})
+	if err != nil {
+		w.failed.Add(uint64(count))
+		slog.ErrorContext(ctx, "Failed to write "+kind+" analytics rows", "rows", count, "error", err)
+		return
+	}
+	w.written.Add(uint64(count))
+}
+
+// increment returns the counters of a share, adding them if needed
+func increment(increments map[uuid.UUID]*counters, shareID uuid.UUID) *counters {
+	if increments[shareID] == nil {
+		increments[shareID] = &counters{}
+	}
+	return increments[shareID]
+}
+
+// locate returns the country and city of an address, if known
+func locate(ip *string) (*string, *string) {
+	if ip == nil {
+		return nil, nil
+	}
+	location := geoip.Lookup(*ip)
+	return location.Country, location.City
+}
+
+// applyCounters increments the download and view counts of many shares in a single statement
+func applyCounters(tx *gorm.DB, increments map[uuid.UUID]*counters) error {
+	if len(increments) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(increments))
+	args := make([]interface{}, 0, len(increments)*3)
+	for shareID, c := range increments {
+		values = append(values, "(?::uuid, ?::integer, ?::integer)")
+		args = append(args, shareID, c.downloads, c.views)
+	}
+
+	return tx.Exec(fmt.Sprintf(`
+		UPDATE ps_shares AS s
+		SET download_count = s.download_count + v.downloads,
+			view_count = s.view_count + v.views
+		FROM (VALUES %s) AS v(id, downloads, views)
+		WHERE s.id = v.id
+	`, strings.Join(values, ", ")), args...).Error
+}
+
+// close stops accepting events and waits for the queue to be flushed
+func (w *writer) close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("analytics queue not flushed, %d events pending: %w", len(w.queue), ctx.Err())
+	}
+}
+
+func (w *writer) stats() Stats {
+	return Stats{
+		Enqueued:      w.enqueued.Load(),
+		Written:       w.written.Load(),
+		Dropped:       w.dropped.Load(),
+		Failed:        w.failed.Load(),
+		Backpressure:  w.backpressure.Load(),
+		QueueDepth:    len(w.queue),
+		QueueCapacity: cap(w.queue),
+	}
+}
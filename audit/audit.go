@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/user"
+
+	"planarcomputer/pss-fs/analytics"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Audited events
+const (
+	EventSignatureIssued   = "signature.issued"
+	EventSignatureConsumed = "signature.consumed"
+	EventSignatureRejected = "signature.rejected"
+	EventUploadAccepted    = "upload.accepted"
+	EventUploadRejected    = "upload.rejected"
+	EventFileDeleted       = "file.deleted"
+	EventShareDeleted      = "share.deleted"
+	EventAnalyticsDeleted  = "analytics.deleted"
+	EventPasswordFailed    = "share.password_failed"
+	EventAdminAction       = "admin.action"
+)
+
+// Outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// LocalsActorUserID is the fiber.Ctx local holding the authenticated user's ID, if any
+const LocalsActorUserID = logging.LocalsActorUserID
+
+// Entry describes an event to record
+type Entry struct {
+	Event   string
+	Outcome string
+	ShareId *uuid.UUID
+	FileId  *uuid.UUID
+	Reason  string
+	Details map[string]interface{}
+}
+
+// Log records an event triggered by an HTTP request, capturing the caller's identity and address,
+// anonymised as for analytics.
+// Failures to write are logged but never fail the request.
+func Log(c *fiber.Ctx, entry Entry) {
+	record := newRecord(entry)
+	record.IpAddress = analytics.AnonymizeIP(utils.ClientIP(c))
+	record.UserAgent = utils.GetStringPtr(c.Get("User-Agent"))
+	if actor, ok := c.Locals(LocalsActorUserID).(uuid.UUID); ok {
+		record.ActorUserId = &actor
+	}
+
+	write(c.UserContext(), record)
+}
+
+// LogCLI records an administrative action run from the command line
+func LogCLI(action string, details map[string]interface{}) {
+	record := newRecord(Entry{Event: EventAdminAction, Outcome: OutcomeSuccess, Reason: action, Details: details})
+	record.Actor = utils.GetStringPtr(cliActor())
+
+	write(context.Background(), record)
+}
+
+func newRecord(entry Entry) *models.PsAuditLog {
+	outcome := entry.Outcome
+	if outcome == "" {
+		outcome = OutcomeSuccess
+	}
+
+	return &models.PsAuditLog{
+		Event:   entry.Event,
+		Outcome: outcome,
+		ShareId: entry.ShareId,
+		FileId:  entry.FileId,
+		Reason:  utils.GetStringPtr(entry.Reason),
+		Details: entry.Details,
+	}
+}
+
+func write(ctx context.Context, record *models.PsAuditLog) {
+	if err := database.DB.WithContext(ctx).Create(record).Error; err != nil {
+		slog.WarnContext(ctx, "Failed to write audit log entry", "event", record.Event, "error", err)
+	}
+}
+
+// cliActor identifies who ran a command line action
+func cliActor() string {
+	hostname, _ := os.Hostname()
+	if current, err := user.Current(); err == nil {
+		return "cli:" + current.Username + "@" + hostname
+	}
+	return "cli@" + hostname
+}
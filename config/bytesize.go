@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes, written as a plain number or with a unit such as 100MB.
+// Units are powers of 1024, KiB, MiB, GiB and TiB are accepted too.
+type ByteSize int64
+
+// Byte size units
+const (
+	B  ByteSize = 1
+	KB          = 1024 * B
+	MB          = 1024 * KB
+	GB          = 1024 * MB
+	TB          = 1024 * GB
+)
+
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"TB", TB}, {"GB", GB}, {"MB", MB}, {"KB", KB},
+}
+
+// ParseByteSize parses a size such as 1048576, 512KB or 1.5GB
+func ParseByteSize(s string) (ByteSize, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.Replace(value, "IB", "B", 1)
+
+	unit := B
+	for _, u := range byteUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			unit, value = u.size, strings.TrimSuffix(value, u.suffix)
+			break
+		}
+	}
+	value = strings.TrimSpace(strings.TrimSuffix(value, "B"))
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s', expected bytes or a size such as 100MB", s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+// String writes the size with the largest unit that divides it exactly
+func (b ByteSize) String() string {
+	for _, u := range byteUnits {
+		if b != 0 && b%u.size == 0 {
+			return strconv.FormatInt(int64(b/u.size), 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
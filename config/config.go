@@ -1,96 +1,360 @@
 package config
 
 import (
-	"log"
-	"os"
-
-	"github.com/joho/godotenv"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Config holds all configuration values
+// Config holds all configuration values. Values are layered: defaults, then the configuration
+// file (YAML or TOML), then environment variables, then command line flags.
 type Config struct {
-	Database DatabaseConfig
-	Server   ServerConfig
-	Storage  StorageConfig
+	Database  DatabaseConfig  `yaml:"database" toml:"database"`
+	Server    ServerConfig    `yaml:"server" toml:"server"`
+	TLS       TLSConfig       `yaml:"tls" toml:"tls"`
+	Storage   StorageConfig   `yaml:"storage" toml:"storage"`
+	Upload    UploadConfig    `yaml:"upload" toml:"upload"`
+	Analytics AnalyticsConfig `yaml:"analytics" toml:"analytics"`
+	Tracing   TracingConfig   `yaml:"tracing" toml:"tracing"`
+	Health    HealthConfig    `yaml:"health" toml:"health"`
 }
 
 // DatabaseConfig holds database-related configuration
 type DatabaseConfig struct {
-	Host        string
-	User        string
-	Password    string
-	Name        string
-	Port        string
-	SSLMode     string
-	TimeZone    string
-	DatabaseURL string
+	Host        string `yaml:"host" toml:"host"`
+	User        string `yaml:"user" toml:"user"`
+	Password    string `yaml:"password" toml:"password"`
+	Name        string `yaml:"name" toml:"name"`
+	Port        string `yaml:"port" toml:"port"`
+	SSLMode     string `yaml:"sslmode" toml:"sslmode"`
+	TimeZone    string `yaml:"timezone" toml:"timezone"`
+	DatabaseURL string `yaml:"url" toml:"url"` // used instead of the fields above when set
+
+	// MaxOpenConns caps the connection pool, 0 means unlimited
+	MaxOpenConns int `yaml:"max_open_conns" toml:"max_open_conns"`
 }
 
 // ServerConfig holds server-related configuration
 type ServerConfig struct {
-	Port string
+	Port string `yaml:"port" toml:"port"`
+
+	// BodyLimit is the largest request body accepted, 0 derives it from Upload.MaxFileSize
+	BodyLimit ByteSize `yaml:"body_limit" toml:"body_limit"`
+
+	// CORSOrigins are the browser origins allowed to call the API, https://*.example.com allows
+	// every subdomain
+	CORSOrigins []string `yaml:"cors_origins" toml:"cors_origins"`
+
+	// CORSMethods and CORSHeaders are the methods and request headers allowed by CORS preflights,
+	// which browsers may cache for CORSMaxAge
+	CORSMethods          []string      `yaml:"cors_methods" toml:"cors_methods"`
+	CORSHeaders          []string      `yaml:"cors_headers" toml:"cors_headers"`
+	CORSMaxAge           time.Duration `yaml:"cors_max_age" toml:"cors_max_age"`
+	CORSAllowCredentials bool          `yaml:"cors_allow_credentials" toml:"cors_allow_credentials"`
+
+	// TrustedProxies are the CIDRs (e.g. Traefik's network) whose X-Forwarded-For and X-Real-IP
+	// headers are honoured
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+
+	// ManagementToken authenticates the SvelteKit backend on the management API, acting for the
+	// user in X-User-ID. ManagementAdminToken also allows admin scope. Both empty disables the API.
+	ManagementToken      string `yaml:"management_token" toml:"management_token"`
+	ManagementAdminToken string `yaml:"management_admin_token" toml:"management_admin_token"`
+
+	// MetricsEnabled exposes Prometheus metrics on /metrics, off by default, behind MetricsToken when set
+	MetricsEnabled bool   `yaml:"metrics_enabled" toml:"metrics_enabled"`
+	MetricsToken   string `yaml:"metrics_token" toml:"metrics_token"`
+
+	// LogLevel is the minimum level logged: debug, info, warn or error
+	LogLevel string `yaml:"log_level" toml:"log_level"`
+
+	// ShutdownTimeout is how long in-flight transfers may take to finish on shutdown before they are aborted
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+}
+
+// TLSConfig holds the settings for serving TLS directly, without a reverse proxy in front
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files, TLS is enabled when both are set. They are reloaded when
+	// they change, checked every ReloadInterval (0 only reloads on SIGHUP).
+	CertFile       string        `yaml:"cert_file" toml:"cert_file"`
+	KeyFile        string        `yaml:"key_file" toml:"key_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval" toml:"reload_interval"`
+	MinVersion     string        `yaml:"min_version" toml:"min_version"`
+
+	// ClientCAFile is a PEM bundle of CAs, when set the management API also requires a client
+	// certificate signed by one of them
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+
+	// HTTP2Port runs a second, net/http listener serving the same routes over HTTP/2, 0 disables it
+	HTTP2Port int `yaml:"http2_port" toml:"http2_port"`
+}
+
+// Enabled reports whether the server terminates TLS itself
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
 }
 
 // StorageConfig holds storage-related configuration
 type StorageConfig struct {
-	FilesDirectory string
-	MaxFileSize    string
+	FilesDirectory string `yaml:"files_directory" toml:"files_directory"`
+
+	// Encryption at rest, master keys are "id:base64key" pairs with the first one active
+	EncryptionEnabled bool     `yaml:"encryption_at_rest" toml:"encryption_at_rest"`
+	MasterKeys        []string `yaml:"master_keys" toml:"master_keys"`
+	MasterKeyFile     string   `yaml:"master_key_file" toml:"master_key_file"`
 }
 
-// Load loads configuration from environment variables
-func Load() *Config {
-	// Try to load from multiple possible env files
-	envFiles := []string{".env", "config.env", ".env.local"}
-
-	var loadedFile string
-	for _, file := range envFiles {
-		if err := godotenv.Load(file); err == nil {
-			loadedFile = file
-			log.Printf("Loaded environment variables from: %s", file)
-			break
-		}
-	}
+// UploadConfig holds the default upload policy, which per-plan limits can tighten
+type UploadConfig struct {
+	MaxFileSize       ByteSize `yaml:"max_file_size" toml:"max_file_size"`             // 0 means unlimited
+	MaxFilesPerShare  int      `yaml:"max_files_per_share" toml:"max_files_per_share"` // 0 means unlimited
+	AllowedMimetypes  []string `yaml:"allowed_mimetypes" toml:"allowed_mimetypes"`
+	BlockedMimetypes  []string `yaml:"blocked_mimetypes" toml:"blocked_mimetypes"`
+	AllowedExtensions []string `yaml:"allowed_extensions" toml:"allowed_extensions"`
+	BlockedExtensions []string `yaml:"blocked_extensions" toml:"blocked_extensions"`
+}
 
-	if loadedFile == "" {
-		log.Println("No .env file found, using system environment variables")
-	}
+// AnalyticsConfig holds analytics-related configuration
+type AnalyticsConfig struct {
+	// Secret keys visitor fingerprints, a random one is used when unset (fingerprints then reset on restart)
+	Secret string `yaml:"secret" toml:"secret"`
+	// VisitDedupWindow is how long repeat visits from the same visitor count as one
+	VisitDedupWindow time.Duration `yaml:"visit_dedup_window" toml:"visit_dedup_window"`
+
+	// GeoIPDatabase is the path to a MaxMind City or Country database, locations are omitted without one
+	GeoIPDatabase string `yaml:"geoip_database" toml:"geoip_database"`
 
-	// Debug: Print what DB_NAME is actually loaded
-	dbName := getEnv("DB_NAME", "")
-	log.Printf("DB_NAME from environment: '%s'", dbName)
+	// Events are queued in memory and written in batches, events are dropped when the queue is full
+	QueueSize     int           `yaml:"queue_size" toml:"queue_size"`
+	BatchSize     int           `yaml:"batch_size" toml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"`
 
-	config := &Config{
+	// DownloadCountThreshold is the fraction of a file or archive that must be sent for a download to count
+	DownloadCountThreshold float64 `yaml:"download_count_threshold" toml:"download_count_threshold"`
+	// BotUserAgents are extra user agent substrings, besides the built-in crawlers and link-preview
+	// fetchers, whose downloads aren't recorded
+	BotUserAgents []string `yaml:"bot_user_agents" toml:"bot_user_agents"`
+
+	// RollupInterval is how often the rollup tables used by analytics reports are refreshed
+	RollupInterval time.Duration `yaml:"rollup_interval" toml:"rollup_interval"`
+
+	// IPMode is how client addresses are stored: full, truncate (to IPv4Prefix/IPv6Prefix bits),
+	// hash (keyed with Secret, which is then required) or none
+	IPMode     string `yaml:"ip_mode" toml:"ip_mode"`
+	IPv4Prefix int    `yaml:"ipv4_prefix" toml:"ipv4_prefix"`
+	IPv6Prefix int    `yaml:"ipv6_prefix" toml:"ipv6_prefix"`
+	// StoreUserAgents keeps visitors' user agents with their analytics rows
+	StoreUserAgents bool `yaml:"store_user_agents" toml:"store_user_agents"`
+
+	// RetentionDays is how long raw analytics rows are kept, 0 keeps them forever. Older rows
+	// survive only in the rollups, which are deleted too unless RetentionKeepRollups is set.
+	RetentionDays        int  `yaml:"retention_days" toml:"retention_days"`
+	RetentionKeepRollups bool `yaml:"retention_keep_rollups" toml:"retention_keep_rollups"`
+}
+
+// TracingConfig holds OpenTelemetry tracing configuration
+type TracingConfig struct {
+	// Exporter is where spans are sent: none, stdout or otlp. The OTLP exporter is configured
+	// with the standard OTEL_EXPORTER_OTLP_* variables.
+	Exporter    string `yaml:"exporter" toml:"exporter"`
+	ServiceName string `yaml:"service_name" toml:"service_name"`
+	// SampleRatio is the fraction of new traces recorded, traces started by the caller follow its decision
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+// HealthConfig holds the thresholds of the readiness checks
+type HealthConfig struct {
+	// MinFreeBytes is the free space below which the files directory's disk is reported as not ready
+	MinFreeBytes ByteSize `yaml:"min_free_bytes" toml:"min_free_bytes"`
+	// PoolSaturation is the fraction of MaxOpenConns in use above which the pool is reported as not ready
+	PoolSaturation float64 `yaml:"pool_saturation" toml:"pool_saturation"`
+}
+
+// Default returns the configuration used for anything not set by a file, environment variable or flag
+func Default() *Config {
+	return &Config{
 		Database: DatabaseConfig{
-			Host:        getEnv("DB_HOST", "localhost"),
-			User:        getEnv("DB_USER", "postgres"),
-			Password:    getEnv("DB_PASSWORD", ""),
-			Name:        dbName,
-			Port:        getEnv("DB_PORT", "5432"),
-			SSLMode:     getEnv("DB_SSLMODE", "disable"),
-			TimeZone:    getEnv("DB_TIMEZONE", "UTC"),
-			DatabaseURL: getEnv("DATABASE_URL", ""),
+			Host:     "localhost",
+			User:     "postgres",
+			Port:     "5432",
+			SSLMode:  "disable",
+			TimeZone: "UTC",
 		},
 		Server: ServerConfig{
-			Port: getEnv("PORT", "3000"),
+			Port: "3000",
+			CORSOrigins: []string{
+				"http://localhost:5173",
+				"http://localhost:3000",
+				"http://127.0.0.1:5173",
+				"http://127.0.0.1:3000",
+				"https://planarshare.com",
+			},
+			CORSMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			CORSHeaders: []string{
+				"Origin", "Accept", "Content-Type", "Content-Length", "Accept-Encoding",
+				"X-CSRF-Token", "Authorization", "X-Requested-With", "X-Share-Password",
+			},
+			CORSMaxAge:           10 * time.Minute,
+			CORSAllowCredentials: true,
+			LogLevel:             "info",
+			ShutdownTimeout:      30 * time.Second,
+		},
+		TLS: TLSConfig{
+			ReloadInterval: time.Minute,
+			MinVersion:     "1.2",
 		},
 		Storage: StorageConfig{
-			FilesDirectory: getEnv("FILES_DIRECTORY", "./files"),
-			MaxFileSize:    getEnv("MAX_FILE_SIZE", "104857600"), // 100MB
+			FilesDirectory: "./files",
+		},
+		Upload: UploadConfig{
+			MaxFileSize: 100 * MB,
 		},
+		Analytics: AnalyticsConfig{
+			VisitDedupWindow:       30 * time.Minute,
+			QueueSize:              10000,
+			BatchSize:              500,
+			FlushInterval:          2 * time.Second,
+			RollupInterval:         5 * time.Minute,
+			DownloadCountThreshold: 0.9,
+			IPMode:                 "full",
+			IPv4Prefix:             24,
+			IPv6Prefix:             48,
+			StoreUserAgents:        true,
+			RetentionKeepRollups:   true,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			ServiceName: "pss-fs",
+			SampleRatio: 1,
+		},
+		Health: HealthConfig{
+			MinFreeBytes:   GB,
+			PoolSaturation: 0.9,
+		},
+	}
+}
+
+// Validate checks the configuration, reporting every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(s setting, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s (%s) %s", s.env, s.key, fmt.Sprintf(format, args...)))
 	}
 
-	// Validate required fields
-	if config.Database.Name == "" {
-		log.Fatal("DB_NAME is required but not set in environment variables")
+	for _, s := range c.settings() {
+		// Numbers are never negative, and fractions are between 0 and 1
+		switch v := s.value.(type) {
+		case *int:
+			if *v < 0 {
+				invalid(s, "must not be negative, got %d", *v)
+			}
+		case *time.Duration:
+			if *v < 0 {
+				invalid(s, "must not be negative, got %s", *v)
+			}
+		case *ByteSize:
+			if *v < 0 {
+				invalid(s, "must not be negative, got %d", *v)
+			}
+		case *float64:
+			if *v < 0 || *v > 1 {
+				invalid(s, "must be between 0 and 1, got %g", *v)
+			}
+		}
+
+		switch s.value {
+		case &c.Database.Name:
+			if c.Database.Name == "" && c.Database.DatabaseURL == "" {
+				invalid(s, "is required unless DATABASE_URL is set")
+			}
+		case &c.Server.Port:
+			if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+				invalid(s, "must be a port number, got '%s'", c.Server.Port)
+			}
+		case &c.Server.LogLevel:
+			if !oneOf(strings.ToLower(c.Server.LogLevel), "debug", "info", "warn", "error") {
+				invalid(s, "must be debug, info, warn or error, got '%s'", c.Server.LogLevel)
+			}
+		case &c.Server.CORSOrigins:
+			if oneOf("*", c.Server.CORSOrigins...) {
+				invalid(s, "can't allow every origin, as requests may carry credentials")
+			}
+		case &c.Server.CORSMethods:
+			for _, method := range c.Server.CORSMethods {
+				if !oneOf(strings.ToUpper(method), "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS") {
+					invalid(s, "must be HTTP methods, got '%s'", method)
+				}
+			}
+		case &c.TLS.CertFile, &c.TLS.KeyFile:
+			if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+				invalid(s, "requires both TLS_CERT_FILE and TLS_KEY_FILE")
+			}
+		case &c.TLS.MinVersion:
+			if !oneOf(c.TLS.MinVersion, "1.2", "1.3") {
+				invalid(s, "must be 1.2 or 1.3, got '%s'", c.TLS.MinVersion)
+			}
+		case &c.TLS.ClientCAFile:
+			if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+				invalid(s, "requires TLS_CERT_FILE and TLS_KEY_FILE")
+			}
+		case &c.TLS.HTTP2Port:
+			if c.TLS.HTTP2Port != 0 && !c.TLS.Enabled() {
+				invalid(s, "requires TLS_CERT_FILE and TLS_KEY_FILE, browsers only speak HTTP/2 over TLS")
+			}
+			if c.TLS.HTTP2Port > 65535 || strconv.Itoa(c.TLS.HTTP2Port) == c.Server.Port {
+				invalid(s, "must be a port number other than PORT, got %d", c.TLS.HTTP2Port)
+			}
+		case &c.Server.ManagementAdminToken:
+			if c.Server.ManagementAdminToken != "" && c.Server.ManagementAdminToken == c.Server.ManagementToken {
+				invalid(s, "must differ from MANAGEMENT_API_TOKEN")
+			}
+		case &c.Storage.FilesDirectory:
+			if c.Storage.FilesDirectory == "" {
+				invalid(s, "is required")
+			}
+		case &c.Storage.EncryptionEnabled:
+			if c.Storage.EncryptionEnabled && len(c.Storage.MasterKeys) == 0 && c.Storage.MasterKeyFile == "" {
+				invalid(s, "requires ENCRYPTION_MASTER_KEYS or ENCRYPTION_KEY_FILE")
+			}
+		case &c.Analytics.QueueSize, &c.Analytics.BatchSize, &c.Analytics.FlushInterval, &c.Analytics.RollupInterval:
+			if reflect.ValueOf(s.value).Elem().Int() == 0 {
+				invalid(s, "must be greater than 0")
+			}
+		case &c.Analytics.IPMode:
+			if !oneOf(c.Analytics.IPMode, "full", "truncate", "hash", "none") {
+				invalid(s, "must be full, truncate, hash or none, got '%s'", c.Analytics.IPMode)
+			}
+			// A random key would make stored hashes unlinkable across restarts and unverifiable
+			if c.Analytics.IPMode == "hash" && c.Analytics.Secret == "" {
+				invalid(s, "hash requires ANALYTICS_SECRET")
+			}
+		case &c.Analytics.IPv4Prefix:
+			if c.Analytics.IPv4Prefix > 32 {
+				invalid(s, "must be at most 32, got %d", c.Analytics.IPv4Prefix)
+			}
+		case &c.Analytics.IPv6Prefix:
+			if c.Analytics.IPv6Prefix > 128 {
+				invalid(s, "must be at most 128, got %d", c.Analytics.IPv6Prefix)
+			}
+		case &c.Tracing.Exporter:
+			if !oneOf(c.Tracing.Exporter, "none", "stdout", "otlp") {
+				invalid(s, "must be none, stdout or otlp, got '%s'", c.Tracing.Exporter)
+			}
+		}
 	}
 
-	return config
+	return errors.Join(errs...)
 }
 
-// getEnv gets an environment variable with a default fallback
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// oneOf reports whether value is one of allowed
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
 	}
-	return defaultValue
+	return false
 }
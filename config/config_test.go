@@ -0,0 +1,46 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string
+	}{
+		{"defaults", func(c *Config) {}, ""},
+		{"zero flush interval", func(c *Config) { c.Analytics.FlushInterval = 0 }, "ANALYTICS_FLUSH_INTERVAL"},
+		{"negative flush interval", func(c *Config) { c.Analytics.FlushInterval = -time.Second }, "ANALYTICS_FLUSH_INTERVAL"},
+		{"zero batch size", func(c *Config) { c.Analytics.BatchSize = 0 }, "ANALYTICS_BATCH_SIZE"},
+		{"hash without secret", func(c *Config) { c.Analytics.IPMode = "hash" }, "ANALYTICS_IP_MODE"},
+		{"hash with secret", func(c *Config) {
+			c.Analytics.IPMode = "hash"
+			c.Analytics.Secret = "secret"
+		}, ""},
+		{"admin token reused", func(c *Config) {
+			c.Server.ManagementToken = "token"
+			c.Server.ManagementAdminToken = "token"
+		}, "MANAGEMENT_ADMIN_TOKEN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			c.Database.Name = "pss"
+			tt.change(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Redacted replaces secret values in printed configuration
+const Redacted = "[REDACTED]"
+
+// legacyEnvFiles are tried in order when no env file is given, the first one found is loaded
+var legacyEnvFiles = []string{".env", "config.env", ".env.local"}
+
+// envFileKeys are the environment variables that were set from an env file
+var (
+	envFileMu   sync.Mutex
+	envFileKeys = make(map[string]bool)
+)
+
+// setting binds a configuration value to its environment variable and command line flag
+type setting struct {
+	env    string // environment variable, the flag is its lowercase dashed form
+	key    string // path in configuration files
+	value  any    // pointer to the field
+	secret bool   // redacted when printed
+	reload bool   // applied on SIGHUP without a restart
+}
+
+// settings lists every configurable value
+func (c *Config) settings() []setting {
+	return []setting{
+		{env: "DB_HOST", key: "database.host", value: &c.Database.Host},
+		{env: "DB_USER", key: "database.user", value: &c.Database.User},
+		{env: "DB_PASSWORD", key: "database.password", value: &c.Database.Password, secret: true},
+		{env: "DB_NAME", key: "database.name", value: &c.Database.Name},
+		{env: "DB_PORT", key: "database.port", value: &c.Database.Port},
+		{env: "DB_SSLMODE", key: "database.sslmode", value: &c.Database.SSLMode},
+		{env: "DB_TIMEZONE", key: "database.timezone", value: &c.Database.TimeZone},
+		{env: "DATABASE_URL", key: "database.url", value: &c.Database.DatabaseURL, secret: true},
+		{env: "DB_MAX_OPEN_CONNS", key: "database.max_open_conns", value: &c.Database.MaxOpenConns},
+
+		{env: "PORT", key: "server.port", value: &c.Server.Port},
+		{env: "BODY_LIMIT", key: "server.body_limit", value: &c.Server.BodyLimit},
+		{env: "CORS_ORIGINS", key: "server.cors_origins", value: &c.Server.CORSOrigins, reload: true},
+		{env: "CORS_METHODS", key: "server.cors_methods", value: &c.Server.CORSMethods},
+		{env: "CORS_HEADERS", key: "server.cors_headers", value: &c.Server.CORSHeaders},
+		{env: "CORS_MAX_AGE", key: "server.cors_max_age", value: &c.Server.CORSMaxAge},
+		{env: "CORS_ALLOW_CREDENTIALS", key: "server.cors_allow_credentials", value: &c.Server.CORSAllowCredentials},
+		{env: "TRUSTED_PROXIES", key: "server.trusted_proxies", value: &c.Server.TrustedProxies, reload: true},
+		{env: "MANAGEMENT_API_TOKEN", key: "server.management_token", value: &c.Server.ManagementToken, secret: true},
+		{env: "MANAGEMENT_ADMIN_TOKEN", key: "server.management_admin_token", value: &c.Server.ManagementAdminToken, secret: true},
+		{env: "METRICS_ENABLED", key: "server.metrics_enabled", value: &c.Server.MetricsEnabled},
+		{env: "METRICS_TOKEN", key: "server.metrics_token", value: &c.Server.MetricsToken, secret: true},
+		{env: "LOG_LEVEL", key: "server.log_level", value: &c.Server.LogLevel, reload: true},
+		{env: "SHUTDOWN_TIMEOUT", key: "server.shutdown_timeout", value: &c.Server.ShutdownTimeout},
+
+		{env: "TLS_CERT_FILE", key: "tls.cert_file", value: &c.TLS.CertFile},
+		{env: "TLS_KEY_FILE", key: "tls.key_file", value: &c.TLS.KeyFile},
+		{env: "TLS_RELOAD_INTERVAL", key: "tls.reload_interval", value: &c.TLS.ReloadInterval},
+		{env: "TLS_MIN_VERSION", key: "tls.min_version", value: &c.TLS.MinVersion},
+		{env: "TLS_CLIENT_CA_FILE", key: "tls.client_ca_file", value: &c.TLS.ClientCAFile},
+		{env: "HTTP2_PORT", key: "tls.http2_port", value: &c.TLS.HTTP2Port},
+
+		{env: "FILES_DIRECTORY", key: "storage.files_directory", value: &c.Storage.FilesDirectory},
+		{env: "ENCRYPTION_AT_REST", key: "storage.encryption_at_rest", value: &c.Storage.EncryptionEnabled},
+		{env: "ENCRYPTION_MASTER_KEYS", key: "storage.master_keys", value: &c.Storage.MasterKeys, secret: true},
+		{env: "ENCRYPTION_KEY_FILE", key: "storage.master_key_file", value: &c.Storage.MasterKeyFile},
+
+		{env: "MAX_FILE_SIZE", key: "upload.max_file_size", value: &c.Upload.MaxFileSize},
+		{env: "MAX_FILES_PER_SHARE", key: "upload.max_files_per_share", value: &c.Upload.MaxFilesPerShare, reload: true},
+		{env: "ALLOWED_MIMETYPES", key: "upload.allowed_mimetypes", value: &c.Upload.AllowedMimetypes, reload: true},
+		{env: "BLOCKED_MIMETYPES", key: "upload.blocked_mimetypes", value: &c.Upload.BlockedMimetypes, reload: true},
+		{env: "ALLOWED_EXTENSIONS", key: "upload.allowed_extensions", value: &c.Upload.AllowedExtensions, reload: true},
+		{env: "BLOCKED_EXTENSIONS", key: "upload.blocked_extensions", value: &c.Upload.BlockedExtensions, reload: true},
+
+		{env: "ANALYTICS_SECRET", key: "analytics.secret", value: &c.Analytics.Secret, secret: true},
+		{env: "VISIT_DEDUP_WINDOW", key: "analytics.visit_dedup_window", value: &c.Analytics.VisitDedupWindow},
+		{env: "GEOIP_DATABASE", key: "analytics.geoip_database", value: &c.Analytics.GeoIPDatabase},
+		{env: "ANALYTICS_QUEUE_SIZE", key: "analytics.queue_size", value: &c.Analytics.QueueSize},
+		{env: "ANALYTICS_BATCH_SIZE", key: "analytics.batch_size", value: &c.Analytics.BatchSize},
+		{env: "ANALYTICS_FLUSH_INTERVAL", key: "analytics.flush_interval", value: &c.Analytics.FlushInterval},
+		{env: "DOWNLOAD_COUNT_THRESHOLD", key: "analytics.download_count_threshold", value: &c.Analytics.DownloadCountThreshold},
+		{env: "BOT_USER_AGENTS", key: "analytics.bot_user_agents", value: &c.Analytics.BotUserAgents},
+		{env: "ANALYTICS_ROLLUP_INTERVAL", key: "analytics.rollup_interval", value: &c.Analytics.RollupInterval},
+		{env: "ANALYTICS_IP_MODE", key: "analytics.ip_mode", value: &c.Analytics.IPMode},
+		{env: "ANALYTICS_IPV4_PREFIX", key: "analytics.ipv4_prefix", value: &c.Analytics.IPv4Prefix},
+		{env: "ANALYTICS_IPV6_PREFIX", key: "analytics.ipv6_prefix", value: &c.Analytics.IPv6Prefix},
+		{env: "ANALYTICS_STORE_USER_AGENTS", key: "analytics.store_user_agents", value: &c.Analytics.StoreUserAgents},
+		{env: "ANALYTICS_RETENTION_DAYS", key: "analytics.retention_days", value: &c.Analytics.RetentionDays},
+		{env: "ANALYTICS_RETENTION_KEEP_ROLLUPS", key: "analytics.retention_keep_rollups", value: &c.Analytics.RetentionKeepRollups},
+
+		{env: "TRACING_EXPORTER", key: "tracing.exporter", value: &c.Tracing.Exporter},
+		{env: "OTEL_SERVICE_NAME", key: "tracing.service_name", value: &c.Tracing.ServiceName},
+		{env: "TRACING_SAMPLE_RATIO", key: "tracing.sample_ratio", value: &c.Tracing.SampleRatio},
+
+		{env: "HEALTH_MIN_FREE_BYTES", key: "health.min_free_bytes", value: &c.Health.MinFreeBytes},
+		{env: "HEALTH_POOL_SATURATION", key: "health.pool_saturation", value: &c.Health.PoolSaturation},
+	}
+}
+
+// flagName is the command line flag of an environment variable, e.g. --max-file-size for MAX_FILE_SIZE
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+// Load builds the configuration from its sources and validates it. args are command line flags:
+// --config names a YAML or TOML file (CONFIG_FILE in the environment works too), --env-file a
+// dotenv file loaded into the environment, and every setting has a flag named after its
+// environment variable. Without --env-file the first of .env, config.env and .env.local is loaded.
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("pss-fs", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", "", "YAML or TOML configuration file")
+	envFile := fs.String("env-file", "", "dotenv file loaded into the environment")
+	flags := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flags[s.env] = fs.String(flagName(s.env), "", s.key)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := loadEnvFile(*envFile); err != nil {
+		return nil, err
+	}
+
+	if *configFile == "" {
+		*configFile = os.Getenv("CONFIG_FILE")
+	}
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Environment variables override the file, and flags override both
+	var errs []error
+	for _, s := range settings {
+		if value := os.Getenv(s.env); value != "" {
+			if err := s.set(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s %w", s.env, err))
+			}
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if f.Name == flagName(s.env) {
+				if err := s.set(*flags[s.env]); err != nil {
+					errs = append(errs, fmt.Errorf("--%s %w", f.Name, err))
+				}
+			}
+		}
+	})
+	if err := errors.Join(append(errs, cfg.Validate())...); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadEnvFile loads a dotenv file into the environment. Variables set by the real environment
+// win, variables set by an earlier load of the file are updated so reloads see changes to it.
+func loadEnvFile(path string) error {
+	files, explicit := legacyEnvFiles, path != ""
+	if explicit {
+		files = []string{path}
+	}
+
+	for _, file := range files {
+		values, err := godotenv.Read(file)
+		if err != nil {
+			if explicit {
+				return fmt.Errorf("failed to load env file %s: %w", file, err)
+			}
+			continue
+		}
+
+		envFileMu.Lock()
+		defer envFileMu.Unlock()
+		for key, value := range values {
+			if _, set := os.LookupEnv(key); set && !envFileKeys[key] {
+				continue
+			}
+			os.Setenv(key, value)
+			envFileKeys[key] = true
+		}
+		slog.Info("Loaded environment variables", "file", file)
+		return nil
+	}
+	return nil
+}
+
+// loadFile reads a YAML or TOML configuration file over the current values. Unknown keys are
+// errors, so typos don't silently fall back to defaults.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("invalid config file %s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("config file %s must be .yaml, .yml or .toml", path)
+	}
+
+	slog.Info("Loaded configuration file", "file", path)
+	return nil
+}
+
+// set parses a value from the environment or the command line into the setting
+func (s setting) set(raw string) error {
+	var err error
+	switch v := s.value.(type) {
+	case *string:
+		*v = raw
+	case *bool:
+		*v, err = strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got '%s'", raw)
+		}
+	case *int:
+		*v, err = strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("must be a whole number, got '%s'", raw)
+		}
+	case *float64:
+		*v, err = strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number, got '%s'", raw)
+		}
+	case *time.Duration:
+		*v, err = time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("must be a duration such as 30s or 5m, got '%s'", raw)
+		}
+	case *ByteSize:
+		*v, err = ParseByteSize(raw)
+		return err
+	case *[]string:
+		*v = splitList(raw)
+	default:
+		panic(fmt.Sprintf("config: unsupported setting type %T", s.value))
+	}
+	return nil
+}
+
+// splitList splits a comma-separated list, skipping empty entries
+func splitList(raw string) []string {
+	var list []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Redacted returns a copy of the configuration with secrets replaced
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	for _, s := range redacted.settings() {
+		if !s.secret {
+			continue
+		}
+		switch v := s.value.(type) {
+		case *string:
+			if *v != "" {
+				*v = Redacted
+			}
+		case *[]string:
+			if len(*v) > 0 {
+				*v = []string{Redacted}
+			}
+		}
+	}
+	return &redacted
+}
+
+// Print writes the configuration as YAML, which can be used as a configuration file
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// RestartRequired lists the environment variables of settings that differ in next but can only
+// be applied by restarting
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	current, updated := c.settings(), next.settings()
+	for i, s := range current {
+		if s.reload {
+			continue
+		}
+		if !reflect.DeepEqual(reflect.ValueOf(s.value).Elem().Interface(), reflect.ValueOf(updated[i].value).Elem().Interface()) {
+			changed = append(changed, s.env)
+		}
+	}
+	return changed
+}
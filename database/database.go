@@ -1,11 +1,14 @@
 package database
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"planarcomputer/pss-fs/config"
+	"planarcomputer/pss-fs/logging"
 	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/tracing"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -13,6 +16,13 @@ import (
 
 var DB *gorm.DB
 
+// SchemaVersion is the version of the service tables this build migrates to. Bump it whenever
+// migrateServiceTables changes, so readiness checks catch instances running against an older schema.
+const SchemaVersion = 1
+
+// schemaComponent identifies this service's row in ps_schema_version
+const schemaComponent = "pss-fs"
+
 // Initialize sets up the database connection and runs migrations
 func Initialize(cfg *config.Config) error {
 	var dsn string
@@ -32,38 +42,98 @@ func Initialize(cfg *config.Config) error {
 	}
 
 	var err error
-	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	DB, err = gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logging.Gorm()})
 	if err != nil {
 		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	log.Println("Database connection established")
+	slog.Info("Database connection established")
+
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get database pool: %w", err)
+	}
+	sqlDB.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+
+	// Trace every database call
+	if err := DB.Use(tracing.GormPlugin{}); err != nil {
+		return fmt.Errorf("failed to register database tracing: %w", err)
+	}
 
 	// Check if tables already exist (from Drizzle/SvelteKit app)
 	var tablesExist bool
 	DB.Raw("SELECT EXISTS (SELECT FROM information_schema.tables WHERE table_schema = 'public' AND table_name = 'ps_upload_signatures')").Scan(&tablesExist)
 
 	if tablesExist {
-		log.Println("Database tables already exist (created by Drizzle/SvelteKit), skipping GORM migrations")
-		return nil
+		slog.Info("Database tables already exist (created by Drizzle/SvelteKit), skipping GORM migrations")
+		return migrateServiceTables()
 	}
 
 	// Only run migrations if tables don't exist
-	log.Println("Running GORM migrations...")
+	slog.Info("Running GORM migrations")
 	if err := DB.AutoMigrate(
+		&models.PsPlans{},
 		&models.PsUsers{},
+		&models.PsUserPlan{},
 		&models.PsUsedQuota{},
 		&models.PsShares{},
+		&models.PsShareSettings{},
 		&models.PsUploadSignatures{},
 		&models.PsFiles{},
+		&models.PsDownloadAnalytics{},
+		&models.PsVisitAnalytics{},
 	); err != nil {
 		return fmt.Errorf("failed to run database migrations: %w", err)
 	}
 
-	log.Println("Database migrations completed successfully")
+	slog.Info("Database migrations completed successfully")
+	return migrateServiceTables()
+}
+
+// migrateServiceTables migrates the tables owned by this service rather than the SvelteKit app.
+// These are always migrated, even when Drizzle created the shared tables.
+func migrateServiceTables() error {
+	if err := DB.AutoMigrate(&models.PsAuditLog{}, &models.PsAnalyticsHourly{}, &models.PsAnalyticsDaily{}, &models.PsSchemaVersion{}); err != nil {
+		return fmt.Errorf("failed to migrate service tables: %w", err)
+	}
+
+	// Reject any attempt to rewrite or remove audit history
+	if err := DB.Exec(`
+		CREATE OR REPLACE FUNCTION ps_audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'ps_audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS ps_audit_log_append_only ON ps_audit_log;
+		CREATE TRIGGER ps_audit_log_append_only
+			BEFORE UPDATE OR DELETE ON ps_audit_log
+			FOR EACH ROW EXECUTE FUNCTION ps_audit_log_append_only();
+	`).Error; err != nil {
+		return fmt.Errorf("failed to protect audit log: %w", err)
+	}
+
+	// Record the version, never lowering one recorded by a newer build
+	if err := DB.Exec(`
+		INSERT INTO ps_schema_version (component, version, migrated_at) VALUES (?, ?, NOW())
+		ON CONFLICT (component) DO UPDATE SET version = EXCLUDED.version, migrated_at = EXCLUDED.migrated_at
+		WHERE ps_schema_version.version < EXCLUDED.version
+	`, schemaComponent, SchemaVersion).Error; err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+
 	return nil
 }
 
+// MigratedVersion returns the version of the service tables recorded in the database
+func MigratedVersion(ctx context.Context) (int, error) {
+	var version models.PsSchemaVersion
+	if err := DB.WithContext(ctx).Where("component = ?", schemaComponent).First(&version).Error; err != nil {
+		return 0, err
+	}
+	return version.Version, nil
+}
+
 // GetDB returns the database instance
 func GetDB() *gorm.DB {
 	return DB
@@ -0,0 +1,120 @@
+package geoip
+
+import (
+	"container/list"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// cacheSize is the number of addresses whose locations are kept in memory
+const cacheSize = 10000
+
+// Location is where an address is, either field may be nil when unknown
+type Location struct {
+	Country *string // ISO 3166-1 alpha-2 code
+	City    *string
+}
+
+var (
+	reader    *geoip2.Reader
+	hasCities bool
+
+	mu    sync.Mutex
+	cache = make(map[string]*list.Element)
+	order = list.New()
+)
+
+type cacheEntry struct {
+	ip       string
+	location Location
+}
+
+// Initialize opens a MaxMind City or Country database. Without one, lookups return no location.
+func Initialize(path string) {
+	if path == "" {
+		slog.Info("GEOIP_DATABASE is not set, analytics will not include locations")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		slog.Warn("GeoIP database is not available, analytics will not include locations", "path", path, "error", err)
+		return
+	}
+
+	db, err := geoip2.Open(path)
+	if err != nil {
+		slog.Warn("Failed to open GeoIP database, analytics will not include locations", "path", path, "error", err)
+		return
+	}
+
+	reader = db
+	hasCities = strings.Contains(db.Metadata().DatabaseType, "City")
+	slog.Info("Loaded GeoIP database", "path", path, "type", db.Metadata().DatabaseType)
+}
+
+// Close releases the database
+func Close() {
+	if reader != nil {
+		reader.Close()
+	}
+}
+
+// Lookup returns the location of an address, caching recent results
+func Lookup(address string) Location {
+	if reader == nil || address == "" {
+		return Location{}
+	}
+
+	mu.Lock()
+	if element, ok := cache[address]; ok {
+		order.MoveToFront(element)
+		location := element.Value.(*cacheEntry).location
+		mu.Unlock()
+		return location
+	}
+	mu.Unlock()
+
+	location := lookup(address)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := cache[address]; !ok {
+		cache[address] = order.PushFront(&cacheEntry{ip: address, location: location})
+		if order.Len() > cacheSize {
+			oldest := order.Back()
+			order.Remove(oldest)
+			delete(cache, oldest.Value.(*cacheEntry).ip)
+		}
+	}
+	return location
+}
+
+func lookup(address string) Location {
+	ip := net.ParseIP(address)
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() {
+		return Location{}
+	}
+
+	var location Location
+	if hasCities {
+		record, err := reader.City(ip)
+		if err != nil {
+			return location
+		}
+		location.Country = utils.GetStringPtr(record.Country.IsoCode)
+		location.City = utils.GetStringPtr(utils.TruncateString(record.City.Names["en"], 100))
+	} else {
+		record, err := reader.Country(ip)
+		if err != nil {
+			return location
+		}
+		location.Country = utils.GetStringPtr(record.Country.IsoCode)
+	}
+	return location
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"time"
+
+	"planarcomputer/pss-fs/audit"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// shareAccessDenied describes why a share can't be accessed
+type shareAccessDenied struct {
+	status  int
+	message string
+}
+
+// checkShareAccess enforces the share's settings (expiry, download limit and password).
+// The password is only read from the X-Share-Password header, never the URL, so it stays out of logs.
+func checkShareAccess(c *fiber.Ctx, share *models.PsShares) *shareAccessDenied {
+	settings, err := loadShareSettings(c, share.ID)
+	if err != nil {
+		return &shareAccessDenied{500, "Failed to load share settings"}
+	}
+	return checkShareSettings(c, share, settings)
+}
+
+// checkShareSettings enforces already loaded share settings, which may be nil
+func checkShareSettings(c *fiber.Ctx, share *models.PsShares, settings *models.PsShareSettings) *shareAccessDenied {
+	if settings == nil {
+		return nil
+	}
+
+	if settings.Expiry != nil && settings.Expiry.Before(time.Now()) {
+		return &shareAccessDenied{410, "Share has expired"}
+	}
+
+	if settings.DownloadLimit != nil && share.DownloadCount >= *settings.DownloadLimit {
+		return &shareAccessDenied{410, "Share download limit reached"}
+	}
+
+	if settings.PasswordHash != nil && *settings.PasswordHash != "" {
+		password := c.Get("X-Share-Password")
+		if password == "" {
+			return &shareAccessDenied{401, "Password required"}
+		}
+		if !utils.VerifyPassword(*settings.PasswordHash, password) {
+			audit.Log(c, audit.Entry{
+				Event:   audit.EventPasswordFailed,
+				Outcome: audit.OutcomeFailure,
+				ShareId: &share.ID,
+				Reason:  "invalid_password",
+			})
+			return &shareAccessDenied{401, "Invalid password"}
+		}
+	}
+
+	return nil
+}
+
+// loadShareSettings returns the share's settings, or nil when it has none
+func loadShareSettings(c *fiber.Ctx, shareID uuid.UUID) (*models.PsShareSettings, error) {
+	var settings models.PsShareSettings
+	result := database.DB.WithContext(c.UserContext()).Where("share_id = ?", shareID).Limit(1).Find(&settings)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, result.Error
+	}
+	return &settings, nil
+}
+
+// respond sends the denial to the client
+func (d *shareAccessDenied) respond(c *fiber.Ctx) error {
+	return c.Status(d.status).JSON(fiber.Map{"error": d.message})
+}
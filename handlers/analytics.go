@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"planarcomputer/pss-fs/analytics"
+	"planarcomputer/pss-fs/audit"
+	"planarcomputer/pss-fs/logging"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// defaultReportRange is the period reported on when no from is given
+const defaultReportRange = 30 * 24 * time.Hour
+
+// ShareAnalyticsHandler reports a share's downloads and visits over time, with its top files,
+// top referrers and countries, from the analytics rollups
+func ShareAnalyticsHandler(c *fiber.Ctx) error {
+	shareUUID, err := uuid.Parse(c.Params("shareID"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
+	}
+
+	share, err := findManagedShare(c, shareUUID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+	}
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultReportRange)
+	}
+	if !from.Before(to) {
+		return c.Status(400).JSON(fiber.Map{"error": "from must be before to"})
+	}
+
+	limit := c.QueryInt("limit", 10)
+	if limit <= 0 {
+		limit = 10
+	}
+	limit = min(limit, 100)
+
+	report, err := analytics.ShareReport(c.UserContext(), share.ID, from, to, c.Query("bucket", analytics.BucketDay), limit)
+	if errors.Is(err, analytics.ErrInvalidBucket) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid bucket, expected hour, day or week"})
+	}
+	if errors.Is(err, analytics.ErrTooManyBuckets) {
+		return c.Status(400).JSON(fiber.Map{"error": "Time range too large for bucket size"})
+	}
+	if err != nil {
+		logging.Request(c).Error("Failed to build analytics report", logging.KeyShareID, share.ID, logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to query analytics"})
+	}
+
+	return c.JSON(report)
+}
+
+// DeleteShareAnalyticsHandler deletes all recorded analytics of a share, raw rows and rollups
+func DeleteShareAnalyticsHandler(c *fiber.Ctx) error {
+	shareUUID, err := uuid.Parse(c.Params("shareID"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
+	}
+
+	share, err := findManagedShare(c, shareUUID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+	}
+
+	deleted, err := analytics.DeleteShareAnalytics(c.UserContext(), share.ID)
+	if err != nil {
+		logging.Request(c).Error("Failed to delete analytics", logging.KeyShareID, share.ID, logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete analytics"})
+	}
+
+	audit.Log(c, audit.Entry{
+		Event:   audit.EventAnalyticsDeleted,
+		ShareId: &share.ID,
+		Details: map[string]interface{}{"rows": deleted},
+	})
+
+	return c.JSON(fiber.Map{"message": "Analytics deleted successfully", "deleted": deleted})
+}
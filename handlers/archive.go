@@ -0,0 +1,353 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"planarcomputer/pss-fs/analytics"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/metrics"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/storage"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// archiveFormat is a way of packaging several files into one download
+type archiveFormat struct {
+	extension   string
+	contentType string
+	// compress wraps the tar stream, nil for zip and plain tar
+	compress func(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	formatZip    = &archiveFormat{extension: ".zip", contentType: "application/zip"}
+	formatTar    = &archiveFormat{extension: ".tar", contentType: "application/x-tar"}
+	formatTarGz  = &archiveFormat{extension: ".tar.gz", contentType: "application/gzip", compress: newGzipWriter}
+	formatTarZst = &archiveFormat{extension: ".tar.zst", contentType: "application/zstd", compress: newZstdWriter}
+)
+
+// archiveFormats are the values of the format query parameter
+var archiveFormats = map[string]*archiveFormat{
+	"zip":     formatZip,
+	"tar":     formatTar,
+	"tar.gz":  formatTarGz,
+	"tgz":     formatTarGz,
+	"tar.zst": formatTarZst,
+}
+
+// archiveContentTypes map the media types a client may ask for in Accept to their format
+var archiveContentTypes = map[string]*archiveFormat{
+	"application/zip":    formatZip,
+	"application/x-tar":  formatTar,
+	"application/gzip":   formatTarGz,
+	"application/x-gzip": formatTarGz,
+	"application/zstd":   formatTarZst,
+}
+
+// cliUserAgents match command line downloaders, which get a tar stream by default
+var cliUserAgents = regexp.MustCompile(`(?i)^(curl|wget|httpie|aria2|xh)/`)
+
+// incompressibleTypes are mimetypes whose contents are already compressed, stored in zips as they are
+var incompressibleTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic", "image/heif",
+	"video/", "audio/aac", "audio/mpeg", "audio/mp4", "audio/ogg", "audio/opus", "audio/webm", "audio/flac",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd", "application/x-xz",
+	"application/x-bzip2", "application/x-7z-compressed", "application/vnd.rar", "application/x-rar-compressed",
+	"application/epub+zip", "application/java-archive", "application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+}
+
+// negotiateArchiveFormat picks the archive format of a share download: the format query parameter,
+// then an archive type named in Accept, then tar for command line clients and zip for everyone
+// else. explicit reports whether the client asked for a format.
+func negotiateArchiveFormat(c *fiber.Ctx) (format *archiveFormat, explicit bool, err error) {
+	if name := c.Query("format"); name != "" {
+		format, ok := archiveFormats[strings.ToLower(name)]
+		if !ok {
+			return nil, false, errors.New("Invalid format, expected zip, tar, tar.gz or tar.zst")
+		}
+		return format, true, nil
+	}
+
+	// Browsers accept */*, so only an archive type named outright counts
+	accept := strings.ToLower(c.Get(fiber.HeaderAccept))
+	offers := make([]string, 0, len(archiveContentTypes))
+	for contentType := range archiveContentTypes {
+		if strings.Contains(accept, contentType) {
+			offers = append(offers, contentType)
+		}
+	}
+	if len(offers) > 0 {
+		if best := c.Accepts(offers...); best != "" {
+			return archiveContentTypes[best], true, nil
+		}
+	}
+
+	if cliUserAgents.MatchString(c.Get(fiber.HeaderUserAgent)) {
+		return formatTar, false, nil
+	}
+	return formatZip, false, nil
+}
+
+// serveArchive sends files packaged in format. The download is recorded for the share as a
+// whole, or for each file in the archive when perFile is set.
+func serveArchive(c *fiber.Ctx, shareID uuid.UUID, files []models.PsFiles, shareTitle string, store *storage.Store, perFile bool, format *archiveFormat) error {
+	if format == formatZip {
+		return createAndServeZip(c, shareID, files, shareTitle, store, perFile)
+	}
+	return streamTar(c, shareID, files, shareTitle, store, perFile, format)
+}
+
+// zipMethod stores already compressed files as they are and deflates the rest
+func zipMethod(mimetype string) uint16 {
+	mimetype = strings.ToLower(mimetype)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mimetype, prefix) {
+			return zip.Store
+		}
+	}
+	return zip.Deflate
+}
+
+// archiveFolder is a folder entry of an archive, dated like the newest file inside it
+type archiveFolder struct {
+	name     string
+	modified time.Time
+}
+
+// archiveLayout names the entries of an archive of files: the folders their relative paths need,
+// parents first, and each file's path. Names are unique ignoring case, folders that differ only
+// in case are merged, and files clashing with a folder or another file are renamed, so the archive
+// extracts cleanly on every platform.
+func archiveLayout(files []models.PsFiles) ([]archiveFolder, []string) {
+	fileDirs := make([]string, len(files))
+	folders := make(map[string]int) // lowercase path to index in the layout
+	var layout []archiveFolder
+	entryNames := map[string]map[string]bool{"": {}}
+
+	for i, file := range files {
+		var dir string
+		if file.RelativePath != nil {
+			// Paths are checked on upload, rows written elsewhere are checked again
+			dir, _ = utils.SanitizeRelativePath(*file.RelativePath)
+		}
+
+		parent := ""
+		for _, segment := range strings.Split(dir, "/") {
+			if segment == "" {
+				break
+			}
+			key := strings.ToLower(parent + segment)
+			index, ok := folders[key]
+			if !ok {
+				index = len(layout)
+				folders[key] = index
+				entryNames[parent][strings.ToLower(segment)] = true
+				layout = append(layout, archiveFolder{name: parent + segment + "/"})
+				entryNames[layout[index].name] = map[string]bool{}
+			}
+			parent = layout[index].name
+			if file.CreatedAt.After(layout[index].modified) {
+				layout[index].modified = file.CreatedAt
+			}
+		}
+		fileDirs[i] = parent
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = fileDirs[i] + utils.UniqueFileName(entryNames[fileDirs[i]], utils.SanitizeFileName(file.FileName))
+	}
+	return layout, names
+}
+
+// tarEntry is a file or folder in a tar stream, a file's data starts at dataOffset
+type tarEntry struct {
+	file       *models.PsFiles // nil for folders
+	header     *tar.Header
+	dataOffset int64
+}
+
+// streamTar streams files as a tar archive, compressed for tar.gz and tar.zst. Entry sizes come
+// from the files' records, so the archive is written as it is sent without a temporary copy, and
+// plain tar archives are sent with their length.
+func streamTar(c *fiber.Ctx, shareID uuid.UUID, files []models.PsFiles, shareTitle string, store *storage.Store, perFile bool, format *archiveFormat) error {
+	logger := logging.Request(c)
+	entries, size := planTar(logger, shareID, files, store)
+
+	var fileEntries []tarEntry
+	for _, entry := range entries {
+		if entry.file != nil {
+			fileEntries = append(fileEntries, entry)
+		}
+	}
+	if len(fileEntries) == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "No files found in share"})
+	}
+
+	var download analytics.Tracker
+	if perFile {
+		archive := &analytics.ArchiveDownload{}
+		for _, entry := range fileEntries {
+			archive.Add(analytics.StartDownload(c, shareID, &entry.file.ID, entry.file.Size), entry.dataOffset)
+		}
+		download = archive
+	} else {
+		download = analytics.StartDownload(c, shareID, nil, size)
+	}
+
+	// The request context is recycled once the handler returns, the stream outlives it
+	ctx, span := tracer.Start(c.UserContext(), "tar.stream", trace.WithAttributes(
+		attribute.Int("pssfs.files", len(fileEntries)),
+		attribute.Int64("pssfs.size", size),
+		attribute.String("pssfs.format", strings.TrimPrefix(format.extension, ".")),
+	))
+	body := download.Track(streamWriter(func(w io.Writer) error {
+		defer span.End()
+		err := writeTar(ctx, w, store, entries)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			span.RecordError(err)
+			logger.Warn("Failed to stream tar archive", logging.KeyShareID, shareID, logging.KeyError, err)
+		}
+		return err
+	}), 0, size)
+
+	c.Set("Content-Type", format.contentType)
+	c.Set("Content-Disposition", utils.ContentDisposition("attachment", shareTitle+format.extension))
+
+	if format.compress == nil {
+		return c.SendStream(metrics.Download(body), int(size))
+	}
+
+	// Compressed archives have no known length and are sent chunked
+	return c.SendStream(metrics.Download(streamWriter(func(w io.Writer) error {
+		defer body.Close()
+		compressor, err := format.compress(w)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(compressor, body); err != nil {
+			compressor.Close()
+			return err
+		}
+		return compressor.Close()
+	})))
+}
+
+// planTar lays out the tar entries of files and the archive's total size. Files whose blob is
+// missing are left out of the archive.
+func planTar(logger *slog.Logger, shareID uuid.UUID, files []models.PsFiles, store *storage.Store) ([]tarEntry, int64) {
+	present := make([]models.PsFiles, 0, len(files))
+	for _, file := range files {
+		if _, err := os.Stat(store.Path(file.ID)); err != nil {
+			logger.Warn("Failed to add file to tar", logging.KeyShareID, shareID, logging.KeyFileID, file.ID, logging.KeyError, err)
+			continue
+		}
+		present = append(present, file)
+	}
+
+	folders, names := archiveLayout(present)
+	planned := make([]tarEntry, 0, len(folders)+len(present))
+	for _, folder := range folders {
+		planned = append(planned, tarEntry{header: &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     folder.name,
+			Mode:     0o755,
+			ModTime:  folder.modified,
+		}})
+	}
+	for i := range present {
+		planned = append(planned, tarEntry{file: &present[i], header: &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     names[i],
+			Size:     present[i].Size,
+			Mode:     0o644,
+			ModTime:  present[i].CreatedAt,
+		}})
+	}
+
+	entries := planned[:0]
+	var offset int64
+	for _, entry := range planned {
+		// Headers are as long as the writer makes them, which depends on the name
+		var headerSize countingWriter
+		if err := tar.NewWriter(&headerSize).WriteHeader(entry.header); err != nil {
+			logger.Warn("Failed to add entry to tar", logging.KeyShareID, shareID, "entry", entry.header.Name, logging.KeyError, err)
+			continue
+		}
+
+		entry.dataOffset = offset + int64(headerSize)
+		entries = append(entries, entry)
+		offset += int64(headerSize) + (entry.header.Size+511)/512*512
+	}
+
+	// The archive ends with two zero blocks
+	return entries, offset + 2*512
+}
+
+// writeTar writes the entries as a tar archive
+func writeTar(ctx context.Context, w io.Writer, store *storage.Store, entries []tarEntry) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(entry.header); err != nil {
+			return err
+		}
+		if entry.file == nil {
+			continue
+		}
+
+		blob, err := store.Open(ctx, entry.file)
+		if err != nil {
+			return fmt.Errorf("file %s: %w", entry.file.ID, err)
+		}
+		_, err = io.CopyN(tw, blob, entry.header.Size)
+		blob.Close()
+		if err != nil {
+			return fmt.Errorf("file %s: %w", entry.file.ID, err)
+		}
+	}
+	return tw.Close()
+}
+
+// streamWriter runs write in the background and returns a reader of what it writes. Closing the
+// reader makes write's next write fail, stopping it.
+func streamWriter(write func(w io.Writer) error) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(write(w))
+	}()
+	return r
+}
+
+func newGzipWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, gzip.BestSpeed)
+}
+
+func newZstdWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+}
+
+// countingWriter counts the bytes written to it and discards them
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
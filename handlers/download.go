@@ -2,67 +2,87 @@ package handlers
 
 import (
 	"archive/zip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"planarcomputer/pss-fs/analytics"
 	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/metrics"
 	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/storage"
 	"planarcomputer/pss-fs/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
-	"gorm.io/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("planarcomputer/pss-fs/handlers")
+
 // DownloadFileHandler handles individual file downloads
-func DownloadFileHandler(filesDir string) fiber.Handler {
+func DownloadFileHandler(store *storage.Store) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		fileID := c.Params("fileID")
-		if fileID == "" {
-			return c.Status(400).JSON(fiber.Map{"error": "File ID is required"})
-		}
-
-		// Parse UUID
-		fileUUID, err := uuid.Parse(fileID)
-		if err != nil {
-			return c.Status(400).JSON(fiber.Map{"error": "Invalid file ID format"})
+		file, err := findDownloadableFile(c)
+		if file == nil {
+			return err
 		}
 
-		// Get file from database
-		var file models.PsFiles
-		result := database.DB.Where("id = ? AND deleted_at IS NULL", fileUUID).First(&file)
-		if result.Error != nil {
-			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
-		}
+		// Set original filename in Content-Disposition
+		c.Set("Content-Disposition", utils.ContentDisposition("attachment", file.FileName))
+		c.Set("Content-Type", file.Mimetype)
 
-		// Log download analytics
-		analytics := models.PsDownloadAnalytics{
-			ShareId:   file.ShareId,
-			FileId:    &file.ID,
-			IpAddress: utils.GetStringPtr(c.IP()),
-			UserAgent: utils.GetStringPtr(c.Get("User-Agent")),
-		}
-		database.DB.Create(&analytics)
+		// The download is recorded, and counted if enough of it was sent, once the transfer ends
+		download := analytics.StartDownload(c, file.ShareId, &file.ID, file.Size)
+		return sendStoredFile(c, store, file, download)
+	}
+}
 
-		// Update download count for the share
-		database.DB.Model(&models.PsShares{}).Where("id = ?", file.ShareId).Update("download_count", gorm.Expr("download_count + 1"))
+// findDownloadableFile loads the file named in the route if its share may be downloaded from,
+// responding itself and returning a nil file otherwise
+func findDownloadableFile(c *fiber.Ctx) (*models.PsFiles, error) {
+	fileID := c.Params("fileID")
+	if fileID == "" {
+		return nil, c.Status(400).JSON(fiber.Map{"error": "File ID is required"})
+	}
 
-		// Serve file using file ID as filename
-		filePath := filepath.Join(filesDir, file.ID.String())
+	// Parse UUID
+	fileUUID, err := uuid.Parse(fileID)
+	if err != nil {
+		return nil, c.Status(400).JSON(fiber.Map{"error": "Invalid file ID format"})
+	}
 
-		// Set original filename in Content-Disposition
-		c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", file.FileName))
-		c.Set("Content-Type", file.Mimetype)
+	// Get file from database
+	var file models.PsFiles
+	result := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", fileUUID).First(&file)
+	if result.Error != nil {
+		return nil, c.Status(404).JSON(fiber.Map{"error": "File not found"})
+	}
 
-		return c.SendFile(filePath)
+	// Files are only reachable while their share is
+	var share models.PsShares
+	result = database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", file.ShareId).First(&share)
+	if result.Error != nil {
+		return nil, c.Status(404).JSON(fiber.Map{"error": "File not found"})
+	}
+	if denied := checkShareAccess(c, &share); denied != nil {
+		return nil, denied.respond(c)
 	}
+	return &file, nil
 }
 
-// DownloadShareHandler handles share downloads (single file or zip)
-func DownloadShareHandler(filesDir string) fiber.Handler {
+// DownloadShareHandler handles share downloads: the file itself for single file shares, otherwise
+// an archive in the negotiated format
+func DownloadShareHandler(store *storage.Store) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		shareID := c.Params("shareID")
 		if shareID == "" {
@@ -75,51 +95,174 @@ func DownloadShareHandler(filesDir string) fiber.Handler {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
 		}
 
+		format, explicitFormat, err := negotiateArchiveFormat(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
 		// Get share from database
 		var share models.PsShares
-		result := database.DB.Where("id = ? AND deleted_at IS NULL", shareUUID).First(&share)
+		result := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", shareUUID).First(&share)
 		if result.Error != nil {
 			return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
 		}
+		if denied := checkShareAccess(c, &share); denied != nil {
+			return denied.respond(c)
+		}
 
 		// Get files in the share
 		var files []models.PsFiles
-		database.DB.Where("share_id = ? AND deleted_at IS NULL", shareUUID).Find(&files)
+		database.DB.WithContext(c.UserContext()).Where("share_id = ? AND deleted_at IS NULL", shareUUID).Order("created_at ASC").Find(&files)
 
 		if len(files) == 0 {
 			return c.Status(404).JSON(fiber.Map{"error": "No files found in share"})
 		}
 
-		// Log download analytics
-		analytics := models.PsDownloadAnalytics{
-			ShareId:   shareUUID,
-			IpAddress: utils.GetStringPtr(c.IP()),
-			UserAgent: utils.GetStringPtr(c.Get("User-Agent")),
+		// End-to-end encrypted shares can't be zipped, hand the client a manifest instead
+		if hasE2eeFiles(files) {
+			return sendE2eeManifest(c, shareUUID, files)
 		}
-		database.DB.Create(&analytics)
-
-		// Update download count
-		database.DB.Model(&models.PsShares{}).Where("id = ?", shareUUID).Update("download_count", gorm.Expr("download_count + 1"))
 
-		if len(files) == 1 {
+		if len(files) == 1 && !explicitFormat {
 			// Single file - serve directly
 			file := files[0]
-			filePath := filepath.Join(filesDir, file.ID.String())
 
 			// Set original filename in Content-Disposition
-			c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", file.FileName))
+			c.Set("Content-Disposition", utils.ContentDisposition("attachment", file.FileName))
 			c.Set("Content-Type", file.Mimetype)
 
-			return c.SendFile(filePath)
+			// The download is recorded, and counted if enough of it was sent, once the transfer ends
+			download := analytics.StartDownload(c, shareUUID, nil, file.Size)
+			return sendStoredFile(c, store, &file, download)
 		}
 
-		// Multiple files - create zip
-		return createAndServeZip(c, files, share.Title, filesDir)
+		// Multiple files, or an archive was asked for
+		return serveArchive(c, shareUUID, files, share.Title, store, false, format)
 	}
 }
 
-// createAndServeZip creates a ZIP file from multiple files and serves it
-func createAndServeZip(c *fiber.Ctx, files []models.PsFiles, shareTitle string, filesDir string) error {
+// maxSelectedFiles caps how many files one selective download may name
+const maxSelectedFiles = 1000
+
+// FileSelectionRequest names the files of a share to download, as a JSON body or form fields
+type FileSelectionRequest struct {
+	FileIds []string `json:"file_ids" form:"file_ids"`
+}
+
+// DownloadSelectionHandler downloads the chosen files of a share, archived unless only one is chosen.
+// The file IDs come from file_ids in the query (comma-separated or repeated) or in the POST body,
+// and must all be files of the share that weren't deleted. Each file's download is recorded.
+func DownloadSelectionHandler(store *storage.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		shareUUID, err := uuid.Parse(c.Params("shareID"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
+		}
+
+		fileIDs, err := selectedFileIDs(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		format, explicitFormat, err := negotiateArchiveFormat(c)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		var share models.PsShares
+		result := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", shareUUID).First(&share)
+		if result.Error != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+		}
+		if denied := checkShareAccess(c, &share); denied != nil {
+			return denied.respond(c)
+		}
+
+		var found []models.PsFiles
+		result = database.DB.WithContext(c.UserContext()).
+			Where("id IN ? AND share_id = ? AND deleted_at IS NULL", fileIDs, shareUUID).
+			Find(&found)
+		if result.Error != nil {
+			logging.Request(c).Error("Failed to load selected files", logging.KeyShareID, shareUUID, logging.KeyError, result.Error)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to load files"})
+		}
+
+		// Files are archived in the order they were chosen
+		byID := make(map[uuid.UUID]models.PsFiles, len(found))
+		for _, file := range found {
+			byID[file.ID] = file
+		}
+		files := make([]models.PsFiles, 0, len(fileIDs))
+		var missing []uuid.UUID
+		for _, id := range fileIDs {
+			if file, ok := byID[id]; ok {
+				files = append(files, file)
+			} else {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) > 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "Files not found in share", "missing": missing})
+		}
+
+		if hasE2eeFiles(files) {
+			return sendE2eeManifest(c, shareUUID, files)
+		}
+
+		if len(files) == 1 && !explicitFormat {
+			file := files[0]
+			c.Set("Content-Disposition", utils.ContentDisposition("attachment", file.FileName))
+			c.Set("Content-Type", file.Mimetype)
+
+			download := analytics.StartDownload(c, shareUUID, &file.ID, file.Size)
+			return sendStoredFile(c, store, &file, download)
+		}
+
+		return serveArchive(c, shareUUID, files, share.Title, store, true, format)
+	}
+}
+
+// selectedFileIDs reads the distinct file IDs of a selective download
+func selectedFileIDs(c *fiber.Ctx) ([]uuid.UUID, error) {
+	var raw []string
+	for _, value := range c.Context().QueryArgs().PeekMulti("file_ids") {
+		raw = append(raw, strings.Split(string(value), ",")...)
+	}
+	if c.Method() == fiber.MethodPost {
+		var req FileSelectionRequest
+		if err := c.BodyParser(&req); err != nil {
+			return nil, errors.New("Invalid request body")
+		}
+		for _, value := range req.FileIds {
+			raw = append(raw, strings.Split(value, ",")...)
+		}
+	}
+
+	seen := make(map[uuid.UUID]bool, len(raw))
+	ids := make([]uuid.UUID, 0, len(raw))
+	for _, value := range raw {
+		id, err := uuid.Parse(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid file ID format: '%s'", value)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, errors.New("file_ids is required")
+	}
+	if len(ids) > maxSelectedFiles {
+		return nil, fmt.Errorf("At most %d files can be downloaded at once", maxSelectedFiles)
+	}
+	return ids, nil
+}
+
+// createAndServeZip creates a ZIP file from multiple files and serves it. The download is recorded
+// for the share as a whole, or for each file in the archive when perFile is set.
+func createAndServeZip(c *fiber.Ctx, shareID uuid.UUID, files []models.PsFiles, shareTitle string, store *storage.Store, perFile bool) error {
+	buildStarted := time.Now()
 	tempDir := os.TempDir()
 	zipFileName := fmt.Sprintf("share_%s_%d.zip", uuid.New().String(), time.Now().Unix())
 	zipPath := filepath.Join(tempDir, zipFileName)
@@ -128,39 +271,114 @@ func createAndServeZip(c *fiber.Ctx, files []models.PsFiles, shareTitle string,
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create zip file"})
 	}
-	defer zipFile.Close()
 	defer os.Remove(zipPath) // Clean up temp file
 
 	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
 
-	for _, file := range files {
-		// Add file to zip using file ID as filename
-		sourcePath := filepath.Join(filesDir, file.ID.String())
-		sourceFile, err := os.Open(sourcePath)
-		if err != nil {
-			continue
-		}
+	ctx, span := tracer.Start(c.UserContext(), "zip.build", trace.WithAttributes(attribute.Int("pssfs.files", len(files))))
+	defer span.End()
 
-		zipEntry, err := zipWriter.Create(file.FileName)
-		if err != nil {
-			sourceFile.Close()
-			continue
+	folders, entryNames := archiveLayout(files)
+	for _, folder := range folders {
+		header := &zip.FileHeader{Name: folder.name, Modified: folder.modified}
+		header.SetMode(fs.ModeDir | 0o755)
+		if _, err := zipWriter.CreateHeader(header); err != nil {
+			zipFile.Close()
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create zip file"})
 		}
+	}
 
-		_, err = io.Copy(zipEntry, sourceFile)
-		sourceFile.Close()
-		if err != nil {
-			continue
+	entryFiles := make(map[string]*models.PsFiles, len(files))
+	for i, file := range files {
+		// Files that can't be read are left out of the archive
+		entryName := entryNames[i]
+		entryFiles[entryName] = &files[i]
+		if err := addZipEntry(ctx, zipWriter, store, &file, entryName); err != nil {
+			logging.Request(c).Warn("Failed to add file to zip", logging.KeyShareID, shareID, logging.KeyFileID, file.ID, logging.KeyError, err)
 		}
 	}
 
-	zipWriter.Close()
-	zipFile.Close()
+	// Finish the archive and rewind it to send it
+	var size int64
+	err = zipWriter.Close()
+	if err == nil {
+		size, err = zipFile.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = zipFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		zipFile.Close()
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create zip file"})
+	}
+	metrics.ObserveZipBuild(time.Since(buildStarted))
+	span.SetAttributes(attribute.Int64("pssfs.size", size))
 
 	// Set headers for zip download
 	c.Set("Content-Type", "application/zip")
-	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", shareTitle))
+	c.Set("Content-Disposition", utils.ContentDisposition("attachment", shareTitle+".zip"))
+
+	// The temp file is removed when this returns, the open handle keeps it readable until sent
+	if !perFile {
+		return sendContent(c, zipFile, size, analytics.StartDownload(c, shareID, nil, size))
+	}
+
+	download, err := trackZipEntries(c, shareID, zipFile, size, entryFiles)
+	if err != nil {
+		zipFile.Close()
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create zip file"})
+	}
+	return sendContent(c, zipFile, size, download)
+}
+
+// trackZipEntries starts a download for each file in the finished archive, spanning its compressed data
+func trackZipEntries(c *fiber.Ctx, shareID uuid.UUID, zipFile *os.File, size int64, entryFiles map[string]*models.PsFiles) (*analytics.ArchiveDownload, error) {
+	reader, err := zip.NewReader(zipFile, size)
+	if err != nil {
+		return nil, err
+	}
+
+	download := &analytics.ArchiveDownload{}
+	for _, entry := range reader.File {
+		file, ok := entryFiles[entry.Name]
+		if !ok {
+			continue
+		}
+		offset, err := entry.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		download.Add(analytics.StartDownload(c, shareID, &file.ID, int64(entry.CompressedSize64)), offset)
+	}
+	return download, nil
+}
+
+// addZipEntry copies a file into the archive under name, decrypting it if it is encrypted at rest.
+// Already compressed files are stored rather than deflated again.
+func addZipEntry(ctx context.Context, zipWriter *zip.Writer, store *storage.Store, file *models.PsFiles, name string) error {
+	ctx, span := tracer.Start(ctx, "zip.entry", trace.WithAttributes(
+		attribute.String("pssfs.file_id", file.ID.String()),
+		attribute.Int64("pssfs.size", file.Size),
+	))
+	defer span.End()
 
-	return c.SendFile(zipPath)
+	sourceFile, err := store.Open(ctx, file)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer sourceFile.Close()
+
+	zipEntry, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zipMethod(file.Mimetype),
+		Modified: file.CreatedAt,
+	})
+	if err == nil {
+		_, err = io.Copy(zipEntry, sourceFile)
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
 }
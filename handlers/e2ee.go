@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"mime/multipart"
+	"strconv"
+	"time"
+
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// e2eeMimetype is stored for end-to-end encrypted files, whose real type only the client knows
+const e2eeMimetype = "application/octet-stream"
+
+// maxEncryptedMetadataSize caps the client-encrypted metadata blob (after base64 decoding)
+const maxEncryptedMetadataSize = 16 * 1024
+
+// E2eeManifestFile describes one end-to-end encrypted file in a share manifest
+type E2eeManifestFile struct {
+	ID                uuid.UUID `json:"id"`
+	Size              int64     `json:"size"`
+	Hash              string    `json:"hash"`
+	CreatedAt         time.Time `json:"created_at"`
+	EncryptedMetadata *string   `json:"encrypted_metadata"`
+	DownloadURL       string    `json:"download_url"`
+}
+
+// E2eeManifest lists the encrypted files of a share so the client can fetch and decrypt them
+type E2eeManifest struct {
+	ShareId uuid.UUID          `json:"share_id"`
+	E2ee    bool               `json:"e2ee"`
+	Files   []E2eeManifestFile `json:"files"`
+}
+
+// parseE2eeFields reads the optional "e2ee" and "metadata" form fields of an upload
+func parseE2eeFields(form *multipart.Form) (bool, *string, error) {
+	e2ee := false
+	if values := form.Value["e2ee"]; len(values) > 0 {
+		parsed, err := strconv.ParseBool(values[0])
+		if err != nil {
+			return false, nil, errors.New("Invalid e2ee flag")
+		}
+		e2ee = parsed
+	}
+
+	metadata := form.Value["metadata"]
+	if !e2ee {
+		if len(metadata) > 0 {
+			return false, nil, errors.New("Encrypted metadata is only accepted for e2ee uploads")
+		}
+		return false, nil, nil
+	}
+
+	if len(metadata) == 0 || metadata[0] == "" {
+		return false, nil, errors.New("Encrypted metadata is required for e2ee uploads")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(metadata[0])
+	if err != nil {
+		return false, nil, errors.New("Encrypted metadata must be base64 encoded")
+	}
+	if len(decoded) > maxEncryptedMetadataSize {
+		return false, nil, errors.New("Encrypted metadata is too large")
+	}
+
+	return true, &metadata[0], nil
+}
+
+// checkE2eeMode ensures a share never mixes end-to-end encrypted and plaintext files
+func checkE2eeMode(ctx context.Context, shareID uuid.UUID, e2ee bool) error {
+	var mismatched int64
+	result := database.DB.WithContext(ctx).Model(&models.PsFiles{}).
+		Where("share_id = ? AND deleted_at IS NULL AND is_e2ee <> ?", shareID, e2ee).
+		Count(&mismatched)
+	if result.Error != nil {
+		return errors.New("Failed to validate share")
+	}
+
+	if mismatched > 0 {
+		if e2ee {
+			return errors.New("Share already contains files that are not end-to-end encrypted")
+		}
+		return errors.New("Share only accepts end-to-end encrypted files")
+	}
+	return nil
+}
+
+// hasE2eeFiles reports whether any of the files are end-to-end encrypted
+func hasE2eeFiles(files []models.PsFiles) bool {
+	for _, file := range files {
+		if file.IsE2ee {
+			return true
+		}
+	}
+	return false
+}
+
+// sendE2eeManifest responds with the share's encrypted files instead of building an archive
+func sendE2eeManifest(c *fiber.Ctx, shareID uuid.UUID, files []models.PsFiles) error {
+	manifest := E2eeManifest{
+		ShareId: shareID,
+		E2ee:    true,
+		Files:   make([]E2eeManifestFile, 0, len(files)),
+	}
+
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, E2eeManifestFile{
+			ID:                file.ID,
+			Size:              file.Size,
+			Hash:              file.Hash,
+			CreatedAt:         file.CreatedAt,
+			EncryptedMetadata: file.EncryptedMetadata,
+			DownloadURL:       "/d/f/" + file.ID.String(),
+		})
+	}
+
+	return c.JSON(manifest)
+}
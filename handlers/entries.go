@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"planarcomputer/pss-fs/analytics"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/metrics"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/storage"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxArchiveEntries caps how many entries of an archive are read when listing or looking one up
+const maxArchiveEntries = 10000
+
+// Entries over minBombCheckSize may expand at most maxCompressionRatio times their compressed size,
+// anything more is treated as a zip bomb
+const (
+	minBombCheckSize    = 16 << 20
+	maxCompressionRatio = 200
+)
+
+// browsableTypes map the mimetypes of archives whose entries can be listed to their format
+var browsableTypes = map[string]string{
+	"application/zip":              "zip",
+	"application/x-zip-compressed": "zip",
+	"application/x-tar":            "tar",
+}
+
+// ArchiveEntry describes a file, folder or link inside an uploaded archive
+type ArchiveEntry struct {
+	Path           string    `json:"path"`
+	Type           string    `json:"type"` // file, dir, symlink or other
+	Size           int64     `json:"size"`
+	CompressedSize *int64    `json:"compressed_size,omitempty"` // zip only
+	Modified       time.Time `json:"modified"`
+	Mimetype       string    `json:"mimetype,omitempty"` // guessed from the extension
+	Encrypted      bool      `json:"encrypted,omitempty"`
+	DownloadURL    string    `json:"download_url,omitempty"`
+}
+
+// ArchiveEntriesHandler lists the entries of an uploaded zip or tar file, a page at a time. Zips
+// are listed from their central directory and tars by skipping from header to header, so neither
+// is read in full. Entries whose name would escape the archive are left out.
+func ArchiveEntriesHandler(store *storage.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		file, format, err := findBrowsableFile(c)
+		if file == nil {
+			return err
+		}
+
+		limit := c.QueryInt("limit", 100)
+		if limit <= 0 {
+			limit = 100
+		}
+		limit = min(limit, 1000)
+		offset := max(c.QueryInt("offset", 0), 0)
+
+		blob, err := store.Open(c.UserContext(), file)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+		defer blob.Close()
+
+		entries := make([]ArchiveEntry, 0)
+		total := 0
+		truncated := false
+		err = walkArchive(blob, file.Size, format, func(entry ArchiveEntry, _ func() (io.ReadCloser, error)) bool {
+			if total == maxArchiveEntries {
+				truncated = true
+				return false
+			}
+			if total >= offset && len(entries) < limit {
+				if entry.Type == "file" {
+					entry.DownloadURL = "/d/f/" + file.ID.String() + "/entry?path=" + url.QueryEscape(entry.Path)
+				}
+				entries = append(entries, entry)
+			}
+			total++
+			return true
+		})
+		if err != nil {
+			logging.Request(c).Info("Failed to read archive", logging.KeyFileID, file.ID, logging.KeyError, err)
+			return c.Status(422).JSON(fiber.Map{"error": "Failed to read archive"})
+		}
+
+		return c.JSON(fiber.Map{
+			"file_id":   file.ID,
+			"format":    format,
+			"entries":   entries,
+			"total":     total,
+			"truncated": truncated,
+			"limit":     limit,
+			"offset":    offset,
+		})
+	}
+}
+
+// ArchiveEntryHandler streams one file out of an uploaded zip or tar file, named by its path in the
+// listing. Encrypted entries and entries that would expand like a zip bomb are refused. The entry
+// is recorded as a download of the archive.
+func ArchiveEntryHandler(store *storage.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		want, err := utils.SanitizeRelativePath(c.Query("path"))
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid path: " + err.Error()})
+		}
+		if want == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "path is required"})
+		}
+
+		file, format, err := findBrowsableFile(c)
+		if file == nil {
+			return err
+		}
+
+		blob, err := store.Open(c.UserContext(), file)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+		}
+
+		var found *ArchiveEntry
+		var open func() (io.ReadCloser, error)
+		seen := 0
+		err = walkArchive(blob, file.Size, format, func(entry ArchiveEntry, entryOpen func() (io.ReadCloser, error)) bool {
+			if entry.Path == want {
+				found, open = &entry, entryOpen
+				return false
+			}
+			seen++
+			return seen < maxArchiveEntries
+		})
+		if err != nil {
+			blob.Close()
+			logging.Request(c).Info("Failed to read archive", logging.KeyFileID, file.ID, logging.KeyError, err)
+			return c.Status(422).JSON(fiber.Map{"error": "Failed to read archive"})
+		}
+		if found == nil {
+			blob.Close()
+			return c.Status(404).JSON(fiber.Map{"error": "Entry not found"})
+		}
+		if denied := checkEntry(found); denied != "" {
+			blob.Close()
+			return c.Status(422).JSON(fiber.Map{"error": denied})
+		}
+
+		contents, err := open()
+		if err != nil {
+			blob.Close()
+			if errors.Is(err, zip.ErrAlgorithm) {
+				return c.Status(422).JSON(fiber.Map{"error": "Entry uses an unsupported compression method"})
+			}
+			logging.Request(c).Info("Failed to open archive entry", logging.KeyFileID, file.ID, logging.KeyError, err)
+			return c.Status(422).JSON(fiber.Map{"error": "Failed to read archive"})
+		}
+
+		// The entry never yields more than its declared size, whatever its compressed data expands to
+		body := bufio.NewReader(io.LimitReader(contents, found.Size))
+		head, _ := body.Peek(512)
+		mimetype, err := utils.DetectMimetype(bytes.NewReader(head), path.Base(found.Path))
+		if err != nil {
+			mimetype = "application/octet-stream"
+		}
+
+		c.Set("Content-Disposition", utils.ContentDisposition("attachment", path.Base(found.Path)))
+		c.Set("Content-Type", mimetype)
+		c.Set("X-Content-Type-Options", "nosniff")
+
+		download := analytics.StartDownload(c, file.ShareId, &file.ID, found.Size)
+		return c.SendStream(download.Track(metrics.Download(struct {
+			io.Reader
+			io.Closer
+		}{body, closers{contents, blob}}), 0, found.Size), int(found.Size))
+	}
+}
+
+// findBrowsableFile loads the file named in the route like a download, and checks that it is an
+// archive whose entries can be read, responding itself and returning a nil file otherwise
+func findBrowsableFile(c *fiber.Ctx) (*models.PsFiles, string, error) {
+	file, err := findDownloadableFile(c)
+	if file == nil {
+		return nil, "", err
+	}
+
+	// End-to-end encrypted files are stored as application/octet-stream, so they are refused here too
+	format, ok := browsableTypes[utils.BaseMimetype(file.Mimetype)]
+	if !ok {
+		return nil, "", c.Status(415).JSON(fiber.Map{"error": "File is not a zip or tar archive"})
+	}
+	return file, format, nil
+}
+
+// checkEntry returns why an entry can't be extracted, or "" if it can
+func checkEntry(entry *ArchiveEntry) string {
+	switch {
+	case entry.Type != "file":
+		return "Entry is not a file"
+	case entry.Encrypted:
+		return "Entry is encrypted"
+	case entry.CompressedSize != nil && entry.Size > minBombCheckSize && entry.Size/max(*entry.CompressedSize, 1) > maxCompressionRatio:
+		return "Entry expands too much to be extracted safely"
+	}
+	return ""
+}
+
+// walkArchive calls visit with each entry of a zip or tar blob and a function opening its contents,
+// valid until the walk moves past the entry. Walking stops when visit returns false. Entries named
+// with absolute paths or .. are skipped, others are named by their cleaned path.
+func walkArchive(blob storage.File, size int64, format string, visit func(entry ArchiveEntry, open func() (io.ReadCloser, error)) bool) error {
+	if format == "zip" {
+		reader, err := zip.NewReader(&seekReaderAt{r: blob}, size)
+		if err != nil && !errors.Is(err, zip.ErrInsecurePath) {
+			return err
+		}
+		for _, f := range reader.File {
+			entryPath, ok := cleanEntryPath(f.Name)
+			if !ok {
+				continue
+			}
+			compressed := int64(f.CompressedSize64)
+			entry := ArchiveEntry{
+				Path:           entryPath,
+				Type:           entryType(f.Mode()),
+				Size:           int64(f.UncompressedSize64),
+				CompressedSize: &compressed,
+				Modified:       f.Modified,
+				Encrypted:      f.Flags&0x1 != 0,
+			}
+			if !visit(withMimetype(entry), f.Open) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	// Tar data between headers is skipped by seeking rather than read
+	reader := tar.NewReader(blob)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && !errors.Is(err, tar.ErrInsecurePath) {
+			return err
+		}
+		entryPath, ok := cleanEntryPath(header.Name)
+		if !ok {
+			continue
+		}
+		entry := ArchiveEntry{
+			Path:     entryPath,
+			Type:     entryType(header.FileInfo().Mode()),
+			Size:     header.Size,
+			Modified: header.ModTime,
+		}
+		if !visit(withMimetype(entry), func() (io.ReadCloser, error) { return io.NopCloser(reader), nil }) {
+			return nil
+		}
+	}
+}
+
+// cleanEntryPath normalises an entry's name, reporting false for names that would escape the archive
+func cleanEntryPath(name string) (string, bool) {
+	cleaned, err := utils.SanitizeRelativePath(name)
+	return cleaned, err == nil && cleaned != ""
+}
+
+func entryType(mode fs.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "other"
+}
+
+func withMimetype(entry ArchiveEntry) ArchiveEntry {
+	if entry.Type == "file" {
+		entry.Mimetype = utils.BaseMimetype(mime.TypeByExtension(path.Ext(entry.Path)))
+	}
+	return entry
+}
+
+// seekReaderAt reads at offsets of a seekable blob, which zip needs to find its central directory
+type seekReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// closers closes each of its closers in turn, returning the first error
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var first error
+	for _, c := range cs {
+		if err := c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
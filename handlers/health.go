@@ -1,11 +1,163 @@
 package handlers
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
 
-// HealthHandler handles health check requests
+	"planarcomputer/pss-fs/config"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// readinessTimeout bounds the database calls of a readiness check
+const readinessTimeout = 3 * time.Second
+
+// Component statuses reported by the readiness check
+const (
+	statusOK       = "ok"
+	statusFailing  = "failing"
+	statusDisabled = "disabled"
+)
+
+// HealthHandler reports that the process is up and serving (liveness). It checks no dependencies,
+// so a database outage doesn't get the container restarted.
 func HealthHandler(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"message": "File Service API is running",
 		"status":  "healthy",
 	})
 }
+
+// ReadinessHandler reports whether the service can handle requests: the database answers and its
+// pool has room, the files directory is writable with enough free space, and the database schema
+// is at least the version this build expects. It responds 503 when any component is failing.
+// Failures are logged in full but only summarised in the response, which is unauthenticated.
+func ReadinessHandler(store *storage.Store, cfg config.HealthConfig) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx, cancel := context.WithTimeout(c.UserContext(), readinessTimeout)
+		defer cancel()
+
+		components := fiber.Map{
+			"database": checkDatabase(ctx),
+			"pool":     checkPool(cfg.PoolSaturation),
+			"storage":  checkStorage(store),
+			"disk":     checkDisk(store, cfg.MinFreeBytes),
+			"schema":   checkSchema(ctx),
+		}
+
+		ready := true
+		for _, component := range components {
+			if component.(fiber.Map)["status"] == statusFailing {
+				ready = false
+			}
+		}
+
+		if !ready {
+			return c.Status(503).JSON(fiber.Map{"status": "not_ready", "components": components})
+		}
+		return c.JSON(fiber.Map{"status": "ready", "components": components})
+	}
+}
+
+// failing logs why a component failed, along with err if there is one, and describes it with
+// message in the response
+func failing(component, message string, err error, details fiber.Map) fiber.Map {
+	args := []any{"component", component, "reason", message}
+	if err != nil {
+		args = append(args, logging.KeyError, err)
+	}
+	slog.Warn("Readiness check failed", args...)
+
+	status := fiber.Map{"status": statusFailing, "error": message}
+	for k, v := range details {
+		status[k] = v
+	}
+	return status
+}
+
+// checkDatabase pings the database
+func checkDatabase(ctx context.Context) fiber.Map {
+	start := time.Now()
+	sqlDB, err := database.DB.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	if err != nil {
+		return failing("database", "Database is not reachable", err, nil)
+	}
+	return fiber.Map{"status": statusOK, "latency_ms": time.Since(start).Milliseconds()}
+}
+
+// checkPool reports the connection pool as failing when more than saturation of its connections are in use
+func checkPool(saturation float64) fiber.Map {
+	sqlDB, err := database.DB.DB()
+	if err != nil {
+		return failing("pool", "Database pool is not available", err, nil)
+	}
+
+	stats := sqlDB.Stats()
+	details := fiber.Map{
+		"in_use":     stats.InUse,
+		"idle":       stats.Idle,
+		"max_open":   stats.MaxOpenConnections,
+		"wait_count": stats.WaitCount,
+	}
+	if stats.MaxOpenConnections > 0 && float64(stats.InUse) > saturation*float64(stats.MaxOpenConnections) {
+		return failing("pool", "Database pool is saturated", nil, details)
+	}
+
+	details["status"] = statusOK
+	return details
+}
+
+// checkStorage writes and reads back a probe file in the files directory
+func checkStorage(store *storage.Store) fiber.Map {
+	if err := store.Probe(); err != nil {
+		return failing("storage", "Files directory is not writable", err, nil)
+	}
+	return fiber.Map{"status": statusOK}
+}
+
+// checkDisk reports the files directory's disk as failing when less than minFree bytes are available
+func checkDisk(store *storage.Store, minFree config.ByteSize) fiber.Map {
+	if minFree == 0 {
+		return fiber.Map{"status": statusDisabled}
+	}
+
+	free, err := store.FreeSpace()
+	if errors.Is(err, errors.ErrUnsupported) {
+		return fiber.Map{"status": statusDisabled}
+	}
+	if err != nil {
+		return failing("disk", "Free disk space is unknown", err, nil)
+	}
+
+	details := fiber.Map{"free_bytes": free, "min_free_bytes": minFree}
+	if free < uint64(minFree) {
+		return failing("disk", "Free disk space is below the threshold", nil, details)
+	}
+
+	details["status"] = statusOK
+	return details
+}
+
+// checkSchema reports the schema as failing when it is older than the version this build migrates to
+func checkSchema(ctx context.Context) fiber.Map {
+	version, err := database.MigratedVersion(ctx)
+	if err != nil {
+		return failing("schema", "Schema version is unknown", err, fiber.Map{"expected": database.SchemaVersion})
+	}
+
+	details := fiber.Map{"version": version, "expected": database.SchemaVersion}
+	if version < database.SchemaVersion {
+		return failing("schema", "Schema is older than expected", nil, details)
+	}
+
+	details["status"] = statusOK
+	return details
+}
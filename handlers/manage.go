@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"time"
+
+	"planarcomputer/pss-fs/audit"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ManagementAuth protects the management API with shared bearer tokens. The SvelteKit
+// backend acts on behalf of a signed-in user by passing their ID in X-User-ID, which
+// scopes every request to that user's shares. Only the admin token may leave it out for
+// admin scope; with the user token, requests without X-User-ID are rejected.
+func ManagementAuth(token, adminToken string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		provided, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		admin := ok && tokenMatches(provided, adminToken)
+		if !admin && (!ok || !tokenMatches(provided, token)) {
+			return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+		}
+
+		userID := c.Get("X-User-ID")
+		if userID == "" {
+			if !admin {
+				return c.Status(403).JSON(fiber.Map{"error": "X-User-ID is required"})
+			}
+			return c.Next()
+		}
+		userUUID, err := uuid.Parse(userID)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid X-User-ID format"})
+		}
+		c.Locals(audit.LocalsActorUserID, userUUID)
+
+		return c.Next()
+	}
+}
+
+// tokenMatches compares a bearer token in constant time, an unset token never matches
+func tokenMatches(provided, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// RequireClientCert rejects requests that didn't present a client certificate signed by one of
+// the TLS_CLIENT_CA_FILE CAs. The TLS handshake verifies certificates, this enforces that one was sent.
+func RequireClientCert() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		state := c.Context().TLSConnectionState()
+		if state == nil || len(state.VerifiedChains) == 0 {
+			return c.Status(401).JSON(fiber.Map{"error": "Client certificate required"})
+		}
+		return c.Next()
+	}
+}
+
+// actorUserID returns the user the request acts on behalf of, or false for admin requests
+func actorUserID(c *fiber.Ctx) (uuid.UUID, bool) {
+	userID, ok := c.Locals(audit.LocalsActorUserID).(uuid.UUID)
+	return userID, ok
+}
+
+// findManagedShare loads a share the caller may manage. Shares owned by other users are
+// reported as missing so their existence isn't disclosed.
+func findManagedShare(c *fiber.Ctx, shareID uuid.UUID) (*models.PsShares, error) {
+	query := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", shareID)
+	if userID, ok := actorUserID(c); ok {
+		query = query.Where("user_id = ?", userID)
+	}
+
+	var share models.PsShares
+	if err := query.First(&share).Error; err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// AuditLogHandler lists audit log entries, filtered by share, user, event and time range
+func AuditLogHandler(c *fiber.Ctx) error {
+	query := database.DB.WithContext(c.UserContext()).Model(&models.PsAuditLog{})
+
+	// Owners only see events they triggered or that concern their shares
+	if userID, ok := actorUserID(c); ok {
+		if filter := c.Query("user_id"); filter != "" && filter != userID.String() {
+			return c.Status(403).JSON(fiber.Map{"error": "Cannot query other users' events"})
+		}
+		query = query.Where("actor_user_id = ? OR share_id IN (SELECT id FROM ps_shares WHERE user_id = ?)", userID, userID)
+	} else if filter := c.Query("user_id"); filter != "" {
+		userUUID, err := uuid.Parse(filter)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid user_id format"})
+		}
+		query = query.Where("actor_user_id = ? OR share_id IN (SELECT id FROM ps_shares WHERE user_id = ?)", userUUID, userUUID)
+	}
+
+	if shareID := c.Query("share_id"); shareID != "" {
+		shareUUID, err := uuid.Parse(shareID)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid share_id format"})
+		}
+		query = query.Where("share_id = ?", shareUUID)
+	}
+
+	if event := c.Query("event"); event != "" {
+		query = query.Where("event = ?", event)
+	}
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !from.IsZero() {
+		query = query.Where("timestamp >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("timestamp < ?", to)
+	}
+
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 {
+		limit = 100
+	}
+	limit = min(limit, 1000)
+	offset := max(c.QueryInt("offset", 0), 0)
+
+	var entries []models.PsAuditLog
+	if err := query.Order("timestamp DESC").Limit(limit).Offset(offset).Find(&entries).Error; err != nil {
+		logging.Request(c).Error("Failed to query audit log", logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to query audit log"})
+	}
+
+	return c.JSON(fiber.Map{
+		"entries": entries,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// DeleteFileHandler soft-deletes a single file and updates its share's statistics
+func DeleteFileHandler(c *fiber.Ctx) error {
+	fileUUID, err := uuid.Parse(c.Params("fileID"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid file ID format"})
+	}
+
+	var file models.PsFiles
+	if err := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", fileUUID).First(&file).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+	}
+	share, err := findManagedShare(c, file.ShareId)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	err = database.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.PsFiles{}).Where("id = ?", file.ID).Update("deleted_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.PsShares{}).Where("id = ?", share.ID).Updates(map[string]interface{}{
+			"file_count": gorm.Expr("GREATEST(file_count - 1, 0)"),
+			"size":       gorm.Expr("GREATEST(size - ?, 0)", file.Size),
+			"updated_at": time.Now(),
+		}).Error
+	})
+	if err != nil {
+		logging.Request(c).Error("Failed to delete file", logging.KeyShareID, share.ID, logging.KeyFileID, file.ID, logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete file"})
+	}
+
+	if err := utils.UpdateUserQuota(share.UserId); err != nil {
+		logging.Request(c).Warn("Failed to update user quota after delete", logging.KeyUserID, share.UserId, logging.KeyError, err)
+	}
+
+	audit.Log(c, audit.Entry{
+		Event:   audit.EventFileDeleted,
+		ShareId: &share.ID,
+		FileId:  &file.ID,
+		Details: map[string]interface{}{"file_name": file.FileName, "size": file.Size},
+	})
+
+	return c.JSON(fiber.Map{"message": "File deleted successfully"})
+}
+
+// DeleteShareHandler soft-deletes a share and all of its files
+func DeleteShareHandler(c *fiber.Ctx) error {
+	shareUUID, err := uuid.Parse(c.Params("shareID"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
+	}
+
+	share, err := findManagedShare(c, shareUUID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+	}
+
+	now := time.Now()
+	var deletedFiles int64
+	err = database.DB.WithContext(c.UserContext()).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.PsFiles{}).Where("share_id = ? AND deleted_at IS NULL", share.ID).Update("deleted_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		deletedFiles = result.RowsAffected
+		return tx.Model(&models.PsShares{}).Where("id = ?", share.ID).Updates(map[string]interface{}{
+			"deleted_at": now,
+			"updated_at": now,
+		}).Error
+	})
+	if err != nil {
+		logging.Request(c).Error("Failed to delete share", logging.KeyShareID, share.ID, logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete share"})
+	}
+
+	if err := utils.UpdateUserQuota(share.UserId); err != nil {
+		logging.Request(c).Warn("Failed to update user quota after delete", logging.KeyUserID, share.UserId, logging.KeyError, err)
+	}
+
+	audit.Log(c, audit.Entry{
+		Event:   audit.EventShareDeleted,
+		ShareId: &share.ID,
+		Details: map[string]interface{}{"title": share.Title, "files": deletedFiles, "size": share.Size},
+	})
+
+	return c.JSON(fiber.Map{"message": "Share deleted successfully"})
+}
+
+// parseTimeRange reads the optional from/to query parameters as RFC 3339 timestamps or dates
+func parseTimeRange(c *fiber.Ctx) (from, to time.Time, err error) {
+	if from, err = parseTimeParam(c.Query("from")); err != nil {
+		return from, to, errors.New("Invalid from, expected RFC 3339 timestamp or YYYY-MM-DD")
+	}
+	if to, err = parseTimeParam(c.Query("to")); err != nil {
+		return from, to, errors.New("Invalid to, expected RFC 3339 timestamp or YYYY-MM-DD")
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,332 @@
+package handlers
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// manifestSortColumns maps the sort query parameter of file listings to its column
+var manifestSortColumns = map[string]string{
+	"name":    "file_name",
+	"size":    "size",
+	"created": "created_at",
+}
+
+// ShareSettingsManifest describes the settings that limit access to a share
+type ShareSettingsManifest struct {
+	Expiry             *time.Time `json:"expiry"`
+	DownloadLimit      *int       `json:"download_limit"`
+	DownloadsRemaining *int       `json:"downloads_remaining"`
+	PasswordProtected  bool       `json:"password_protected"`
+	CustomSlug         *string    `json:"custom_slug"`
+}
+
+// ShareManifest is a share's metadata, without its files
+type ShareManifest struct {
+	ID            uuid.UUID             `json:"id"`
+	Title         string                `json:"title"`
+	Description   *string               `json:"description"`
+	CreatedAt     time.Time             `json:"created_at"`
+	UpdatedAt     time.Time             `json:"updated_at"`
+	FileCount     int                   `json:"file_count"`
+	Size          int64                 `json:"size"`
+	DownloadCount int                   `json:"download_count"`
+	ViewCount     int                   `json:"view_count"`
+	IsPublic      bool                  `json:"is_public"`
+	Settings      ShareSettingsManifest `json:"settings"`
+	DownloadURL   string                `json:"download_url"`
+	FilesURL      string                `json:"files_url"`
+	TreeURL       string                `json:"tree_url"`
+}
+
+// FileManifest describes a file of a share
+type FileManifest struct {
+	ID                uuid.UUID `json:"id"`
+	FileName          string    `json:"file_name"`
+	RelativePath      *string   `json:"relative_path"`
+	Mimetype          string    `json:"mimetype"`
+	Size              int64     `json:"size"`
+	Hash              string    `json:"hash"`
+	CreatedAt         time.Time `json:"created_at"`
+	IsE2ee            bool      `json:"is_e2ee"`
+	EncryptedMetadata *string   `json:"encrypted_metadata,omitempty"`
+	DownloadURL       string    `json:"download_url"`
+}
+
+// DirectoryManifest is a folder of a share, counting the files of its subfolders too
+type DirectoryManifest struct {
+	Name        string               `json:"name"`
+	Path        string               `json:"path"`
+	FileCount   int                  `json:"file_count"`
+	Size        int64                `json:"size"`
+	Directories []*DirectoryManifest `json:"directories"`
+	Files       []FileManifest       `json:"files"`
+}
+
+// ShareManifestHandler returns a public share's metadata and settings. Shares that aren't public are
+// reported as missing, and the share's settings (expiry, download limit, password) apply as for downloads.
+func ShareManifestHandler(c *fiber.Ctx) error {
+	share, settings, err := findPublicShare(c)
+	if share == nil {
+		return err
+	}
+	return c.JSON(newShareManifest(share, settings, "/api/shares/"))
+}
+
+// ShareFilesHandler lists a public share's files, a page at a time
+func ShareFilesHandler(c *fiber.Ctx) error {
+	share, _, err := findPublicShare(c)
+	if share == nil {
+		return err
+	}
+	return listShareFiles(c, share)
+}
+
+// ShareTreeHandler returns a public share's files arranged in their folders
+func ShareTreeHandler(c *fiber.Ctx) error {
+	share, _, err := findPublicShare(c)
+	if share == nil {
+		return err
+	}
+	return shareTree(c, share)
+}
+
+// ManagedShareManifestHandler returns a share's metadata to its owner, whether or not it is public
+// and regardless of its settings
+func ManagedShareManifestHandler(c *fiber.Ctx) error {
+	share, err := findManagedShareParam(c)
+	if share == nil {
+		return err
+	}
+
+	settings, err := loadShareSettings(c, share.ID)
+	if err != nil {
+		logging.Request(c).Error("Failed to load share settings", logging.KeyShareID, share.ID, logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to load share settings"})
+	}
+	return c.JSON(newShareManifest(share, settings, "/api/manage/shares/"))
+}
+
+// ManagedShareFilesHandler lists a share's files to its owner, whether or not it is public
+func ManagedShareFilesHandler(c *fiber.Ctx) error {
+	share, err := findManagedShareParam(c)
+	if share == nil {
+		return err
+	}
+	return listShareFiles(c, share)
+}
+
+// ManagedShareTreeHandler returns a share's folder tree to its owner, whether or not it is public
+func ManagedShareTreeHandler(c *fiber.Ctx) error {
+	share, err := findManagedShareParam(c)
+	if share == nil {
+		return err
+	}
+	return shareTree(c, share)
+}
+
+// findPublicShare loads the public share named in the route along with its settings, responding
+// itself and returning a nil share when it can't be shown
+func findPublicShare(c *fiber.Ctx) (*models.PsShares, *models.PsShareSettings, error) {
+	shareUUID, err := uuid.Parse(c.Params("shareID"))
+	if err != nil {
+		return nil, nil, c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
+	}
+
+	var share models.PsShares
+	result := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL AND is_public", shareUUID).First(&share)
+	if result.Error != nil {
+		return nil, nil, c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+	}
+
+	settings, err := loadShareSettings(c, share.ID)
+	if err != nil {
+		logging.Request(c).Error("Failed to load share settings", logging.KeyShareID, share.ID, logging.KeyError, err)
+		return nil, nil, c.Status(500).JSON(fiber.Map{"error": "Failed to load share settings"})
+	}
+	if denied := checkShareSettings(c, &share, settings); denied != nil {
+		return nil, nil, denied.respond(c)
+	}
+	return &share, settings, nil
+}
+
+// findManagedShareParam loads the share named in the route if the caller may manage it, responding
+// itself and returning a nil share otherwise
+func findManagedShareParam(c *fiber.Ctx) (*models.PsShares, error) {
+	shareUUID, err := uuid.Parse(c.Params("shareID"))
+	if err != nil {
+		return nil, c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
+	}
+
+	share, err := findManagedShare(c, shareUUID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+	}
+	if err != nil {
+		logging.Request(c).Error("Failed to load share", logging.KeyShareID, shareUUID, logging.KeyError, err)
+		return nil, c.Status(500).JSON(fiber.Map{"error": "Failed to load share"})
+	}
+	return share, nil
+}
+
+// newShareManifest describes share, linking its file listing and tree under filesPrefix
+func newShareManifest(share *models.PsShares, settings *models.PsShareSettings, filesPrefix string) ShareManifest {
+	manifest := ShareManifest{
+		ID:            share.ID,
+		Title:         share.Title,
+		Description:   share.Description,
+		CreatedAt:     share.CreatedAt,
+		UpdatedAt:     share.UpdatedAt,
+		FileCount:     share.FileCount,
+		Size:          share.Size,
+		DownloadCount: share.DownloadCount,
+		ViewCount:     share.ViewCount,
+		IsPublic:      share.IsPublic,
+		DownloadURL:   "/d/s/" + share.ID.String(),
+		FilesURL:      filesPrefix + share.ID.String() + "/files",
+		TreeURL:       filesPrefix + share.ID.String() + "/tree",
+	}
+
+	if settings != nil {
+		manifest.Settings = ShareSettingsManifest{
+			Expiry:            settings.Expiry,
+			DownloadLimit:     settings.DownloadLimit,
+			PasswordProtected: settings.PasswordHash != nil && *settings.PasswordHash != "",
+			CustomSlug:        settings.CustomSlug,
+		}
+		if settings.DownloadLimit != nil {
+			remaining := max(*settings.DownloadLimit-share.DownloadCount, 0)
+			manifest.Settings.DownloadsRemaining = &remaining
+		}
+	}
+	return manifest
+}
+
+// listShareFiles responds with a page of the share's files. The page is chosen with limit (default
+// 100, at most 1000) and offset, and ordered by sort (name, size or created) and order (asc or desc).
+func listShareFiles(c *fiber.Ctx, share *models.PsShares) error {
+	sort := c.Query("sort", "created")
+	column, ok := manifestSortColumns[sort]
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid sort, expected name, size or created"})
+	}
+	order := c.Query("order", "asc")
+	if order != "asc" && order != "desc" {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid order, expected asc or desc"})
+	}
+
+	limit := c.QueryInt("limit", 100)
+	if limit <= 0 {
+		limit = 100
+	}
+	limit = min(limit, 1000)
+	offset := max(c.QueryInt("offset", 0), 0)
+
+	query := database.DB.WithContext(c.UserContext()).Model(&models.PsFiles{}).
+		Where("share_id = ? AND deleted_at IS NULL", share.ID).
+		Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logging.Request(c).Error("Failed to count files", logging.KeyShareID, share.ID, logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to list files"})
+	}
+
+	// The ID breaks ties so pages don't overlap when files share a name, size or timestamp
+	var files []models.PsFiles
+	if err := query.Order(column + " " + order).Order("id " + order).Limit(limit).Offset(offset).Find(&files).Error; err != nil {
+		logging.Request(c).Error("Failed to list files", logging.KeyShareID, share.ID, logging.KeyError, err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to list files"})
+	}
+
+	entries := make([]FileManifest, 0, len(files))
+	for i := range files {
+		entries = append(entries, newFileManifest(&files[i]))
+	}
+
+	return c.JSON(fiber.Map{
+		"files":  entries,
+		"total":  total,
+		"limit":  limit,
+		"offset": offset,
+		"sort":   sort,
+		"order":  order,
+	})
+}
+
+// shareTree responds with all of the share's files arranged in their folders, the root first.
+// Folders and files are ordered by name.
+func shareTree(c *fiber.Ctx, share *models.PsShares) error {
+	var files []models.PsFiles
+	result := database.DB.WithContext(c.UserContext()).
+		Where("share_id = ? AND deleted_at IS NULL", share.ID).
+		Order("relative_path ASC NULLS FIRST").Order("file_name ASC").Order("id ASC").
+		Find(&files)
+	if result.Error != nil {
+		logging.Request(c).Error("Failed to list files", logging.KeyShareID, share.ID, logging.KeyError, result.Error)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to list files"})
+	}
+
+	root := &DirectoryManifest{Directories: []*DirectoryManifest{}, Files: []FileManifest{}}
+	folders := map[string]*DirectoryManifest{"": root}
+	for i := range files {
+		file := &files[i]
+		dir := root
+		dir.FileCount++
+		dir.Size += file.Size
+
+		if file.RelativePath != nil {
+			for _, segment := range strings.Split(*file.RelativePath, "/") {
+				if segment == "" {
+					continue
+				}
+				path := strings.TrimPrefix(dir.Path+"/"+segment, "/")
+				child, ok := folders[path]
+				if !ok {
+					child = &DirectoryManifest{Name: segment, Path: path, Directories: []*DirectoryManifest{}, Files: []FileManifest{}}
+					folders[path] = child
+					dir.Directories = append(dir.Directories, child)
+				}
+				dir = child
+				dir.FileCount++
+				dir.Size += file.Size
+			}
+		}
+		dir.Files = append(dir.Files, newFileManifest(file))
+	}
+
+	// Files come ordered by folder and name, folders are sorted once they are all known
+	for _, folder := range folders {
+		sort.Slice(folder.Directories, func(i, j int) bool {
+			return folder.Directories[i].Name < folder.Directories[j].Name
+		})
+	}
+
+	return c.JSON(root)
+}
+
+// newFileManifest describes a file of a share
+func newFileManifest(file *models.PsFiles) FileManifest {
+	return FileManifest{
+		ID:                file.ID,
+		FileName:          file.FileName,
+		RelativePath:      file.RelativePath,
+		Mimetype:          file.Mimetype,
+		Size:              file.Size,
+		Hash:              file.Hash,
+		CreatedAt:         file.CreatedAt,
+		IsE2ee:            file.IsE2ee,
+		EncryptedMetadata: file.EncryptedMetadata,
+		DownloadURL:       "/d/f/" + file.ID.String(),
+	}
+}
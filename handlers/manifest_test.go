@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"testing"
+
+	"planarcomputer/pss-fs/models"
+
+	"github.com/google/uuid"
+)
+
+func TestNewShareManifest(t *testing.T) {
+	share := &models.PsShares{ID: uuid.MustParse("6f1c1b8e-4b8e-4c1e-9a3e-1a2b3c4d5e6f"), DownloadCount: 3}
+	limit, remaining := 5, 2
+	hash := "hash"
+
+	tests := []struct {
+		name          string
+		settings      *models.PsShareSettings
+		prefix        string
+		wantFiles     string
+		wantTree      string
+		wantRemaining *int
+		wantPassword  bool
+	}{
+		{"public", nil, "/api/shares/", "/api/shares/" + share.ID.String() + "/files", "/api/shares/" + share.ID.String() + "/tree", nil, false},
+		{"managed", nil, "/api/manage/shares/", "/api/manage/shares/" + share.ID.String() + "/files", "/api/manage/shares/" + share.ID.String() + "/tree", nil, false},
+		{"settings", &models.PsShareSettings{DownloadLimit: &limit, PasswordHash: &hash}, "/api/shares/", "/api/shares/" + share.ID.String() + "/files", "/api/shares/" + share.ID.String() + "/tree", &remaining, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifest := newShareManifest(share, tt.settings, tt.prefix)
+			if manifest.DownloadURL != "/d/s/"+share.ID.String() {
+				t.Errorf("download_url = %q", manifest.DownloadURL)
+			}
+			if manifest.FilesURL != tt.wantFiles {
+				t.Errorf("files_url = %q, want %q", manifest.FilesURL, tt.wantFiles)
+			}
+			if manifest.TreeURL != tt.wantTree {
+				t.Errorf("tree_url = %q, want %q", manifest.TreeURL, tt.wantTree)
+			}
+			if (manifest.Settings.DownloadsRemaining == nil) != (tt.wantRemaining == nil) ||
+				(tt.wantRemaining != nil && *manifest.Settings.DownloadsRemaining != *tt.wantRemaining) {
+				t.Errorf("downloads_remaining = %v, want %v", manifest.Settings.DownloadsRemaining, tt.wantRemaining)
+			}
+			if manifest.Settings.PasswordProtected != tt.wantPassword {
+				t.Errorf("password_protected = %v, want %v", manifest.Settings.PasswordProtected, tt.wantPassword)
+			}
+		})
+	}
+}
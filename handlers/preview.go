@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"planarcomputer/pss-fs/storage"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// previewCSP sandboxes previews like a cross-origin iframe without scripts, forms or plugins, and
+// only lets the browser's own image and media viewers load the file itself
+const previewCSP = "sandbox; default-src 'none'; img-src 'self'; media-src 'self'; style-src 'unsafe-inline'"
+
+// previewTypes map the mimetypes that can be shown inline to the Content-Type they are served
+// with. Formats that can carry scripts, such as HTML and SVG, are left out, and text is always
+// served as plain text.
+var previewTypes = map[string]string{
+	"image/png":       "image/png",
+	"image/jpeg":      "image/jpeg",
+	"image/gif":       "image/gif",
+	"image/webp":      "image/webp",
+	"image/avif":      "image/avif",
+	"image/bmp":       "image/bmp",
+	"application/pdf": "application/pdf",
+	"video/mp4":       "video/mp4",
+	"video/webm":      "video/webm",
+	"video/ogg":       "video/ogg",
+	"audio/mpeg":      "audio/mpeg",
+	"audio/mp4":       "audio/mp4",
+	"audio/aac":       "audio/aac",
+	"audio/ogg":       "audio/ogg",
+	"audio/opus":      "audio/opus",
+	"audio/wav":       "audio/wav",
+	"audio/webm":      "audio/webm",
+	"audio/flac":      "audio/flac",
+	"text/plain":      "text/plain; charset=utf-8",
+	"text/csv":        "text/plain; charset=utf-8",
+	"text/markdown":   "text/plain; charset=utf-8",
+}
+
+// PreviewFileHandler shows a file in the browser rather than downloading it, for images, PDFs,
+// video, audio and plain text. The file is sandboxed and isolated from other origins, supports
+// byte ranges for seeking, and previews aren't recorded as downloads.
+func PreviewFileHandler(store *storage.Store) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		file, err := findDownloadableFile(c)
+		if file == nil {
+			return err
+		}
+
+		// End-to-end encrypted files are stored as application/octet-stream, so they are refused here too
+		contentType, ok := previewTypes[utils.BaseMimetype(file.Mimetype)]
+		if !ok {
+			return c.Status(415).JSON(fiber.Map{"error": "File type can't be previewed"})
+		}
+
+		c.Set("Content-Disposition", utils.ContentDisposition("inline", file.FileName))
+		c.Set("Content-Type", contentType)
+		c.Set("Content-Security-Policy", previewCSP)
+		c.Set("X-Content-Type-Options", "nosniff")
+		c.Set("Cross-Origin-Opener-Policy", "same-origin")
+		c.Set("Cross-Origin-Embedder-Policy", "require-corp")
+		// Same-site rather than same-origin so the web app can embed previews from its own domain
+		c.Set("Cross-Origin-Resource-Policy", "same-site")
+		c.Set("Referrer-Policy", "no-referrer")
+
+		return sendStoredFile(c, store, file, nil)
+	}
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+
+	"planarcomputer/pss-fs/analytics"
+	"planarcomputer/pss-fs/metrics"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// sendStoredFile serves a file's blob, supporting single byte-range requests. Encrypted blobs
+// are decrypted as they stream. The bytes sent are reported to download, which may be nil.
+func sendStoredFile(c *fiber.Ctx, store *storage.Store, file *models.PsFiles, download *analytics.Download) error {
+	blob, err := store.Open(c.UserContext(), file)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "File not found"})
+	}
+
+	return sendContent(c, blob, file.Size, download)
+}
+
+// sendContent streams a seekable reader, honouring a Range header. It takes ownership of r.
+// The body is closed by fasthttp once it has been written or the client went away, which is
+// when download learns how much was sent.
+func sendContent(c *fiber.Ctx, r io.ReadSeekCloser, size int64, download analytics.Tracker) error {
+	c.Set("Accept-Ranges", "bytes")
+
+	rangeHeader := c.Get(fiber.HeaderRange)
+	if rangeHeader == "" {
+		return c.SendStream(download.Track(metrics.Download(r), 0, size), int(size))
+	}
+
+	start, end, err := fasthttp.ParseByteRange([]byte(rangeHeader), int(size))
+	if err != nil {
+		r.Close()
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+		return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+	}
+
+	if _, err := r.Seek(int64(start), io.SeekStart); err != nil {
+		r.Close()
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to read file"})
+	}
+
+	length := end - start + 1
+	c.Status(fiber.StatusPartialContent)
+	c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	return c.SendStream(download.Track(metrics.Download(struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, int64(length)), r}), int64(start), int64(length)), length)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"planarcomputer/pss-fs/audit"
 	"planarcomputer/pss-fs/database"
 	"planarcomputer/pss-fs/models"
 
@@ -47,7 +48,7 @@ func GenerateUploadSignatureHandler(c *fiber.Ctx) error {
 
 	// Check if share exists
 	var share models.PsShares
-	result := database.DB.Where("id = ? AND deleted_at IS NULL", shareUUID).First(&share)
+	result := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", shareUUID).First(&share)
 	if result.Error != nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
 	}
@@ -72,11 +73,17 @@ func GenerateUploadSignatureHandler(c *fiber.Ctx) error {
 		IsUsed:    false,
 	}
 
-	result = database.DB.Create(&uploadSig)
+	result = database.DB.WithContext(c.UserContext()).Create(&uploadSig)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create signature"})
 	}
 
+	audit.Log(c, audit.Entry{
+		Event:   audit.EventSignatureIssued,
+		ShareId: &shareUUID,
+		Details: map[string]interface{}{"signature_id": uploadSig.ID, "expires_at": uploadSig.Expiry},
+	})
+
 	// Encode signature to base64
 	base64Sig := base64.StdEncoding.EncodeToString([]byte(signature))
 
@@ -97,14 +104,14 @@ func GenerateUploadSignatureHandler(c *fiber.Ctx) error {
 func CreateTestShareHandler(c *fiber.Ctx) error {
 	// Create a test user if none exists
 	var testUser models.PsUsers
-	result := database.DB.Where("email = ?", "test@example.com").First(&testUser)
+	result := database.DB.WithContext(c.UserContext()).Where("email = ?", "test@example.com").First(&testUser)
 	if result.Error != nil {
 		testUser = models.PsUsers{
 			GoogleId: "test_user_" + uuid.New().String(),
 			Name:     "Test User",
 			Email:    "test@example.com",
 		}
-		database.DB.Create(&testUser)
+		database.DB.WithContext(c.UserContext()).Create(&testUser)
 	}
 
 	// Create a test share
@@ -114,7 +121,7 @@ func CreateTestShareHandler(c *fiber.Ctx) error {
 		Description: getStringPtr("Test share created via API"),
 	}
 
-	result = database.DB.Create(&share)
+	result = database.DB.WithContext(c.UserContext()).Create(&share)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create test share"})
 	}
@@ -1,16 +1,18 @@
 package handlers
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"io"
-	"log"
-	"os"
-	"path/filepath"
+	"context"
+	"mime/multipart"
+	"strings"
 	"time"
 
+	"planarcomputer/pss-fs/audit"
 	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/metrics"
 	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/policy"
+	"planarcomputer/pss-fs/storage"
 	"planarcomputer/pss-fs/utils"
 
 	"github.com/gofiber/fiber/v2"
@@ -19,57 +21,70 @@ import (
 )
 
 // UploadHandler handles file uploads with signature validation
-func UploadHandler(filesDir string) fiber.Handler {
+func UploadHandler(store *storage.Store, uploadPolicy *policy.Defaults) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		signatureParam := c.Params("signature")
 		if signatureParam == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "Signature is required"})
 		}
 
-		log.Printf("Upload attempt with base64 signature: %s", signatureParam)
+		defer metrics.StartUpload()()
 
 		// Validate signature (search database with base64 signature directly)
 		var uploadSig models.PsUploadSignatures
-		result := database.DB.Where("signature = ? AND is_used = false AND expiry > ?", signatureParam, time.Now()).First(&uploadSig)
+		result := database.DB.WithContext(c.UserContext()).Where("signature = ? AND is_used = false AND expiry > ?", signatureParam, time.Now()).First(&uploadSig)
 		if result.Error != nil {
-			log.Printf("Signature validation failed: %v", result.Error)
-
 			// Check if signature exists at all
 			var existingSig models.PsUploadSignatures
-			existsResult := database.DB.Where("signature = ?", signatureParam).First(&existingSig)
+			existsResult := database.DB.WithContext(c.UserContext()).Where("signature = ?", signatureParam).First(&existingSig)
 			if existsResult.Error != nil {
-				log.Printf("Base64 signature does not exist in database")
-				return c.Status(401).JSON(fiber.Map{"error": "Invalid signature"})
+				return rejectSignature(c, nil, "not_found", "Invalid signature")
 			}
 
 			// Check if already used
 			if existingSig.IsUsed {
-				log.Printf("Signature has already been used at: %v", existingSig.UsedAt)
-				return c.Status(401).JSON(fiber.Map{"error": "Signature has already been used"})
+				return rejectSignature(c, &existingSig, "used", "Signature has already been used")
 			}
 
 			// Check if expired
 			if existingSig.Expiry.Before(time.Now()) {
-				log.Printf("Signature expired at: %v", existingSig.Expiry)
-				return c.Status(401).JSON(fiber.Map{"error": "Signature has expired"})
+				return rejectSignature(c, &existingSig, "expired", "Signature has expired")
 			}
 
-			return c.Status(401).JSON(fiber.Map{"error": "Invalid or expired signature"})
+			return rejectSignature(c, &existingSig, "invalid", "Invalid or expired signature")
 		}
 
-		log.Printf("Signature validated successfully for share_id: %s", uploadSig.ShareId)
+		logger := logging.Request(c).With(logging.KeyShareID, uploadSig.ShareId)
+		logger.Debug("Upload signature validated", "signature_id", uploadSig.ID)
+		metrics.SignatureValidated()
 
 		// Get current file count and size for this share
 		var share models.PsShares
-		if err := database.DB.Where("id = ?", uploadSig.ShareId).First(&share).Error; err != nil {
-			log.Printf("Failed to get share info: %v", err)
+		if err := database.DB.WithContext(c.UserContext()).Where("id = ?", uploadSig.ShareId).First(&share).Error; err != nil {
+			logger.Error("Failed to get share info", logging.KeyError, err)
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to validate share"})
 		}
 
 		// Check if adding this file would exceed expected file count
 		if share.FileCount+1 > uploadSig.ExpectedFileCount {
-			log.Printf("File count limit exceeded: %d/%d", share.FileCount+1, uploadSig.ExpectedFileCount)
-			return c.Status(400).JSON(fiber.Map{"error": "File count limit exceeded"})
+			logger.Info("File count limit exceeded", "file_count", share.FileCount+1, "expected_file_count", uploadSig.ExpectedFileCount)
+			return rejectUpload(c, share.ID, 400, "expected_file_count_exceeded", "File count limit exceeded")
+		}
+
+		// Resolve the upload policy for the share owner's plan
+		rules, err := uploadPolicy.ForShare(c.UserContext(), share.ID)
+		if err != nil {
+			logger.Error("Failed to resolve upload policy", logging.KeyError, err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to validate share"})
+		}
+
+		if violation := rules.CheckFileCount(share.FileCount); violation != nil {
+			return policyViolation(c, share.ID, violation)
+		}
+
+		// Reject oversized bodies before the multipart form is parsed and spooled
+		if violation := rules.CheckRequestSize(int64(c.Request().Header.ContentLength())); violation != nil {
+			return policyViolation(c, share.ID, violation)
 		}
 
 		// Handle single file upload (matching SvelteKit service)
@@ -94,56 +109,180 @@ func UploadHandler(filesDir string) fiber.Handler {
 		// 	return c.Status(400).JSON(fiber.Map{"error": "File size limit exceeded"})
 		// }
 
-		// Generate file ID
-		fileID := uuid.New()
-
-		// Save file to disk using file ID as filename
-		filePath := filepath.Join(filesDir, fileID.String())
-
-		if err := c.SaveFile(file, filePath); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to save file"})
+		// End-to-end encrypted uploads carry ciphertext plus a client-encrypted metadata blob
+		e2ee, encryptedMetadata, err := parseE2eeFields(form)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := checkE2eeMode(c.UserContext(), share.ID, e2ee); err != nil {
+			return rejectUpload(c, share.ID, 409, "e2ee_mode_mismatch", err.Error())
 		}
 
-		// Calculate file hash using SHA-256
-		fileHandle, err := os.Open(filePath)
+		relativePath, err := parseRelativePath(form)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to open file for hashing"})
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid relative path: " + err.Error()})
 		}
-		defer fileHandle.Close()
-
-		hasher := sha256.New()
-		if _, err := io.Copy(hasher, fileHandle); err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to calculate file hash"})
+		// Folder names would reveal what e2ee uploads hide, they belong in the encrypted metadata
+		if e2ee && relativePath != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Relative paths aren't accepted for e2ee uploads"})
 		}
-		hash := hex.EncodeToString(hasher.Sum(nil))
 
 		// Create file record
 		fileRecord := models.PsFiles{
-			ID:       fileID,
-			ShareId:  uploadSig.ShareId,
-			FileName: file.Filename,
-			Mimetype: file.Header.Get("Content-Type"),
-			Hash:     hash,
-			Size:     file.Size,
+			ID:                uuid.New(),
+			ShareId:           uploadSig.ShareId,
+			RelativePath:      relativePath,
+			IsE2ee:            e2ee,
+			EncryptedMetadata: encryptedMetadata,
 		}
 
-		database.DB.Create(&fileRecord)
+		if e2ee {
+			// The server can't see inside the ciphertext, so only the size rules apply
+			fileRecord.FileName = fileRecord.ID.String()
+			fileRecord.Mimetype = e2eeMimetype
+
+			if violation := rules.CheckFileSize(file.Size); violation != nil {
+				return policyViolation(c, share.ID, violation)
+			}
+		} else {
+			// Never trust the client's filename or Content-Type
+			fileRecord.FileName = utils.SanitizeFileName(file.Filename)
+
+			upload, err := file.Open()
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Failed to read uploaded file"})
+			}
+			fileRecord.Mimetype, err = utils.DetectMimetype(upload, fileRecord.FileName)
+			upload.Close()
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Failed to read uploaded file"})
+			}
+
+			// Enforce the size and type rules before anything is written to the files directory
+			if violation := rules.CheckFile(fileRecord.FileName, fileRecord.Mimetype, file.Size); violation != nil {
+				return policyViolation(c, share.ID, violation)
+			}
+		}
+
+		// Save file to disk using file ID as filename, hashing (and encrypting) as it is written
+		upload, err := file.Open()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Failed to read uploaded file"})
+		}
+		defer upload.Close()
+
+		if err := store.Save(c.UserContext(), &fileRecord, upload); err != nil {
+			logger.Error("Failed to save file", logging.KeyFileID, fileRecord.ID, logging.KeyError, err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save file"})
+		}
+
+		// The row holds the only copy of an encrypted blob's data key, so it is written even when the
+		// request is cancelled after the save, and the blob is removed if it can't be
+		if err := database.DB.WithContext(context.WithoutCancel(c.UserContext())).Create(&fileRecord).Error; err != nil {
+			logger.Error("Failed to record file", logging.KeyFileID, fileRecord.ID, logging.KeyError, err)
+			if err := store.Remove(fileRecord.ID); err != nil {
+				logger.Error("Failed to remove unrecorded file", logging.KeyFileID, fileRecord.ID, logging.KeyError, err)
+			}
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to save file"})
+		}
+		metrics.AddUploadedBytes(fileRecord.Size)
 
 		// Update share file count and size (increment by 1 file)
-		database.DB.Model(&models.PsShares{}).Where("id = ?", uploadSig.ShareId).Updates(map[string]interface{}{
+		database.DB.WithContext(c.UserContext()).Model(&models.PsShares{}).Where("id = ?", uploadSig.ShareId).Updates(map[string]interface{}{
 			"file_count": gorm.Expr("file_count + 1"),
-			"size":       gorm.Expr("size + ?", file.Size),
+			"size":       gorm.Expr("size + ?", fileRecord.Size),
 		})
 
 		// Update user quota after successful upload
 		if err := utils.UpdateUserQuotaByShareID(uploadSig.ShareId); err != nil {
-			log.Printf("Warning: Failed to update user quota after upload: %v", err)
+			logger.Warn("Failed to update user quota after upload", logging.KeyError, err)
 			// Don't fail the upload if quota update fails, just log the warning
 		}
 
+		logger.Info("File uploaded", logging.KeyFileID, fileRecord.ID, logging.KeyBytes, fileRecord.Size)
+		audit.Log(c, audit.Entry{
+			Event:   audit.EventSignatureConsumed,
+			ShareId: &share.ID,
+			FileId:  &fileRecord.ID,
+			Details: map[string]interface{}{"signature_id": uploadSig.ID},
+		})
+		audit.Log(c, audit.Entry{
+			Event:   audit.EventUploadAccepted,
+			ShareId: &share.ID,
+			FileId:  &fileRecord.ID,
+			Details: map[string]interface{}{"size": fileRecord.Size, "mimetype": fileRecord.Mimetype, "e2ee": fileRecord.IsE2ee},
+		})
+
 		return c.JSON(fiber.Map{
 			"message": "File uploaded successfully",
 			"file":    fileRecord,
 		})
 	}
 }
+
+// parseRelativePath reads the folder of an upload from the "relative_path" form field, or from
+// "webkitRelativePath" as browsers report it for directory uploads, ending with the file's name
+func parseRelativePath(form *multipart.Form) (*string, error) {
+	var path string
+	if values := form.Value["relative_path"]; len(values) > 0 {
+		path = values[0]
+	} else if values := form.Value["webkitRelativePath"]; len(values) > 0 {
+		path = values[0][:max(strings.LastIndexAny(values[0], `/\`), 0)]
+	}
+
+	dir, err := utils.SanitizeRelativePath(path)
+	if err != nil || dir == "" {
+		return nil, err
+	}
+	return &dir, nil
+}
+
+// policyViolation responds with the status and error code of a rejected upload
+func policyViolation(c *fiber.Ctx, shareID uuid.UUID, violation *policy.Violation) error {
+	logging.Request(c).Info("Upload rejected by policy", logging.KeyShareID, shareID, "reason", violation.Code, "detail", violation.Message)
+	metrics.UploadRejected(violation.Code)
+	audit.Log(c, audit.Entry{
+		Event:   audit.EventUploadRejected,
+		Outcome: audit.OutcomeFailure,
+		ShareId: &shareID,
+		Reason:  violation.Code,
+	})
+
+	return c.Status(violation.Status).JSON(fiber.Map{
+		"error": violation.Message,
+		"code":  violation.Code,
+	})
+}
+
+// rejectUpload records and responds to an upload rejected for a reason other than policy
+func rejectUpload(c *fiber.Ctx, shareID uuid.UUID, status int, reason, message string) error {
+	logging.Request(c).Info("Upload rejected", logging.KeyShareID, shareID, "reason", reason)
+	metrics.UploadRejected(reason)
+	audit.Log(c, audit.Entry{
+		Event:   audit.EventUploadRejected,
+		Outcome: audit.OutcomeFailure,
+		ShareId: &shareID,
+		Reason:  reason,
+	})
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// rejectSignature records and responds to a failed upload signature validation
+func rejectSignature(c *fiber.Ctx, uploadSig *models.PsUploadSignatures, reason, message string) error {
+	metrics.SignatureRejected(reason)
+	entry := audit.Entry{
+		Event:   audit.EventSignatureRejected,
+		Outcome: audit.OutcomeFailure,
+		Reason:  reason,
+	}
+	logger := logging.Request(c).With("reason", reason)
+	if uploadSig != nil {
+		entry.ShareId = &uploadSig.ShareId
+		entry.Details = map[string]interface{}{"signature_id": uploadSig.ID}
+		logger = logger.With(logging.KeyShareID, uploadSig.ShareId, "signature_id", uploadSig.ID)
+	}
+	logger.Info("Upload signature rejected")
+	audit.Log(c, entry)
+
+	return c.Status(401).JSON(fiber.Map{"error": message})
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"time"
+
+	"planarcomputer/pss-fs/analytics"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// previewFileLimit caps how many files are listed in a share preview
+const previewFileLimit = 20
+
+// SharePreviewFile describes a file listed in a share preview
+type SharePreviewFile struct {
+	ID                uuid.UUID `json:"id"`
+	FileName          string    `json:"file_name"`
+	Mimetype          string    `json:"mimetype"`
+	Size              int64     `json:"size"`
+	EncryptedMetadata *string   `json:"encrypted_metadata,omitempty"`
+}
+
+// SharePreview is the share metadata shown on a share's landing page
+type SharePreview struct {
+	ID          uuid.UUID          `json:"id"`
+	Title       string             `json:"title"`
+	Description *string            `json:"description"`
+	CreatedAt   time.Time          `json:"created_at"`
+	FileCount   int                `json:"file_count"`
+	Size        int64              `json:"size"`
+	ViewCount   int                `json:"view_count"`
+	E2ee        bool               `json:"e2ee"`
+	Files       []SharePreviewFile `json:"files"`
+	DownloadURL string             `json:"download_url"`
+}
+
+// ShareVisitHandler returns a share's metadata and a preview of its files, recording the visit
+func ShareVisitHandler(c *fiber.Ctx) error {
+	shareUUID, err := uuid.Parse(c.Params("shareID"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid share ID format"})
+	}
+
+	var share models.PsShares
+	result := database.DB.WithContext(c.UserContext()).Where("id = ? AND deleted_at IS NULL", shareUUID).First(&share)
+	if result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Share not found"})
+	}
+
+	if denied := checkShareAccess(c, &share); denied != nil {
+		return denied.respond(c)
+	}
+
+	// Only visitors who get past the share's settings count, so wrong passwords don't inflate views
+	counted, err := analytics.RecordVisit(c, share.ID)
+	if err != nil {
+		logging.Request(c).Warn("Failed to record visit", logging.KeyShareID, share.ID, logging.KeyError, err)
+	} else if counted {
+		share.ViewCount++
+	}
+
+	var files []models.PsFiles
+	database.DB.WithContext(c.UserContext()).Where("share_id = ? AND deleted_at IS NULL", share.ID).
+		Order("created_at ASC").
+		Limit(previewFileLimit).
+		Find(&files)
+
+	preview := SharePreview{
+		ID:          share.ID,
+		Title:       share.Title,
+		Description: share.Description,
+		CreatedAt:   share.CreatedAt,
+		FileCount:   share.FileCount,
+		Size:        share.Size,
+		ViewCount:   share.ViewCount,
+		E2ee:        hasE2eeFiles(files),
+		Files:       make([]SharePreviewFile, 0, len(files)),
+		DownloadURL: "/d/s/" + share.ID.String(),
+	}
+	for _, file := range files {
+		preview.Files = append(preview.Files, SharePreviewFile{
+			ID:                file.ID,
+			FileName:          file.FileName,
+			Mimetype:          file.Mimetype,
+			Size:              file.Size,
+			EncryptedMetadata: file.EncryptedMetadata,
+		})
+	}
+
+	return c.JSON(preview)
+}
@@ -0,0 +1,31 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm/logger"
+)
+
+// gormSlowThreshold is how long a query may take before it is logged as slow
+const gormSlowThreshold = 200 * time.Millisecond
+
+// gormWriter sends GORM's log lines to slog
+type gormWriter struct{}
+
+func (gormWriter) Printf(format string, args ...interface{}) {
+	slog.Warn("Database", "detail", fmt.Sprintf(format, args...))
+}
+
+// Gorm returns a GORM logger that reports slow queries and errors through slog. Queries are
+// logged with placeholders rather than their values, which can include signatures.
+func Gorm() logger.Interface {
+	return logger.New(gormWriter{}, logger.Config{
+		SlowThreshold:             gormSlowThreshold,
+		LogLevel:                  logger.Warn,
+		IgnoreRecordNotFoundError: true,
+		ParameterizedQueries:      true,
+		Colorful:                  false,
+	})
+}
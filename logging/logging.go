@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Field names shared by every log line, so lines about the same share, file or user can be found
+// together whatever logged them
+const (
+	KeyRequestID = "request_id"
+	KeyShareID   = "share_id"
+	KeyFileID    = "file_id"
+	KeyUserID    = "user_id"
+	KeyBytes     = "bytes"
+	KeyDuration  = "duration" // in milliseconds
+	KeyError     = "error"
+)
+
+// LocalsActorUserID is the fiber.Ctx local holding the authenticated user's ID, if any
+const LocalsActorUserID = "actor_user_id"
+
+// Redacted replaces the values of sensitive fields
+const Redacted = "[REDACTED]"
+
+// redactedKeys are fields whose values are never written: upload signatures are bearer secrets,
+// and client addresses are personal data
+var redactedKeys = map[string]bool{
+	"signature":     true,
+	"ip":            true,
+	"ip_address":    true,
+	"password":      true,
+	"token":         true,
+	"authorization": true,
+}
+
+// level is the minimum level logged, it can be changed while running
+var level slog.LevelVar
+
+// Setup makes a JSON logger writing to stdout at the given level (debug, info, warn or error)
+// the default for both slog and the standard log package
+func Setup(minLevel string) error {
+	if err := SetLevel(minLevel); err != nil {
+		return err
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       &level,
+		ReplaceAttr: replaceAttr,
+	})
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the minimum level logged
+func SetLevel(minLevel string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(minLevel)); err != nil {
+		return fmt.Errorf("invalid log level '%s', expected debug, info, warn or error", minLevel)
+	}
+	level.Set(l)
+	return nil
+}
+
+// replaceAttr redacts sensitive fields and writes durations in milliseconds
+func replaceAttr(_ []string, a slog.Attr) slog.Attr {
+	if redactedKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, Redacted)
+	}
+	if a.Value.Kind() == slog.KindDuration {
+		return slog.Float64(a.Key, float64(a.Value.Duration())/float64(time.Millisecond))
+	}
+	return a
+}
+
+// Fatal logs an error and exits, for failures the service can't start or run without
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
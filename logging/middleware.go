@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderRequestID carries a request's ID from the caller and back in the response
+const HeaderRequestID = "X-Request-ID"
+
+// localsLogger stores the request's logger in the context locals
+const localsLogger = "logger"
+
+// validRequestID accepts caller-provided IDs that are safe to log and echo back
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID assigns every request an ID, reusing the caller's X-Request-ID when it is sane, and
+// returns it in the response. Log lines written through Request(c) carry it, as does the trace span.
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(HeaderRequestID)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewString()
+		}
+		c.Set(HeaderRequestID, id)
+		c.Locals(localsLogger, slog.Default().With(KeyRequestID, id))
+		trace.SpanFromContext(c.UserContext()).SetAttributes(attribute.String("pssfs.request_id", id))
+		return c.Next()
+	}
+}
+
+// Request returns the logger for a request, which adds its request ID to every line
+func Request(c *fiber.Ctx) *slog.Logger {
+	if logger, ok := c.Locals(localsLogger).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// AccessLog writes a line for every request once it has been handled. Only the route pattern is
+// logged, as paths carry upload signatures.
+func AccessLog() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		// Errors are turned into responses after this runs. Fiber's own errors (e.g. for unknown
+		// routes) echo the path, so only their status is kept.
+		status := c.Response().StatusCode()
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+
+		args := []any{
+			"method", c.Method(),
+			"route", c.Route().Path,
+			"status", status,
+			KeyDuration, time.Since(start),
+		}
+		if c.Response().IsBodyStream() {
+			// Streamed bodies are sized up front, how much of them was sent isn't known yet
+			if size := c.Response().Header.ContentLength(); size >= 0 {
+				args = append(args, KeyBytes, size)
+			}
+		} else {
+			args = append(args, KeyBytes, len(c.Response().Body()))
+		}
+		// Only the user the request was authenticated as, never an unchecked X-User-ID header
+		if userID := c.Locals(LocalsActorUserID); userID != nil {
+			args = append(args, KeyUserID, userID)
+		}
+		if err != nil && fiberErr == nil {
+			args = append(args, KeyError, err.Error())
+		}
+		Request(c).Log(c.UserContext(), level, "Request handled", args...)
+		return err
+	}
+}
@@ -1,71 +1,330 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"planarcomputer/pss-fs/analytics"
 	"planarcomputer/pss-fs/config"
 	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/geoip"
 	"planarcomputer/pss-fs/handlers"
+	"planarcomputer/pss-fs/logging"
+	"planarcomputer/pss-fs/metrics"
+	"planarcomputer/pss-fs/policy"
+	"planarcomputer/pss-fs/server"
+	"planarcomputer/pss-fs/storage"
+	"planarcomputer/pss-fs/tracing"
+	"planarcomputer/pss-fs/utils"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 )
 
 func main() {
-	// Load configuration
-	cfg := config.Load()
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		printConfig(args[2:])
+		return
+	}
+
+	// Load configuration from the file, environment and flags
+	cfg := loadConfig(args)
+	if err := logging.Setup(cfg.Server.LogLevel); err != nil {
+		logging.Fatal("Failed to set up logging", "error", err)
+	}
+
+	// Tracing has to be set up before anything that records spans
+	shutdownTracing, err := tracing.Initialize(cfg.Tracing)
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
+	}
 
 	// Initialize database
 	if err := database.Initialize(cfg); err != nil {
-		log.Fatal("Failed to initialize database:", err)
+		logging.Fatal("Failed to initialize database", "error", err)
+	}
+
+	// Only trust forwarded client addresses from known proxies, and only allow known browser origins
+	if err := utils.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		logging.Fatal("Invalid TRUSTED_PROXIES", "error", err)
 	}
+	if err := utils.SetAllowedOrigins(cfg.Server.CORSOrigins); err != nil {
+		logging.Fatal("Invalid CORS_ORIGINS", "error", err)
+	}
+
+	// Initialize analytics, with locations when a GeoIP database is available
+	geoip.Initialize(cfg.Analytics.GeoIPDatabase)
+	defer geoip.Close()
+	analytics.Initialize(cfg)
 
-	// Create files directory if it doesn't exist
-	if err := os.MkdirAll(cfg.Storage.FilesDirectory, 0755); err != nil {
-		log.Fatal("Failed to create files directory:", err)
+	// Create files directory if it doesn't exist and load encryption keys
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		logging.Fatal("Failed to initialize storage", "error", err)
+	}
+	if removed, err := store.RemoveStaleTemp(); err != nil {
+		slog.Warn("Failed to remove incomplete uploads left by a previous run", "error", err)
+	} else if removed > 0 {
+		slog.Info("Removed incomplete uploads left by a previous run", "files", removed)
+	}
+
+	// Upload policy defaults, tightened per plan at upload time
+	uploadPolicy := policy.NewDefaults(cfg.Upload)
+
+	// Unless configured, the body limit follows the largest file any plan may upload
+	bodyLimit := int(cfg.Server.BodyLimit)
+	if bodyLimit == 0 {
+		bodyLimit = math.MaxInt
+		if cfg.Upload.MaxFileSize > 0 {
+			bodyLimit = int(int64(cfg.Upload.MaxFileSize) + policy.MultipartOverhead)
+		}
+	}
+
+	// Certificates for serving TLS without a reverse proxy, reloaded when the files change
+	var certs *server.Certificates
+	if cfg.TLS.Enabled() {
+		if certs, err = server.LoadCertificates(cfg.TLS); err != nil {
+			logging.Fatal("Failed to load TLS certificates", "error", err)
+		}
+		go certs.Watch()
 	}
 
 	// Initialize Fiber app
 	app := fiber.New(fiber.Config{
-		// BodyLimit: 200 * 1024 * 1024, // 200MB limit (increased from 100MB)
-		// BodyLimit: 0, // Unlimited file size
-		// BodyLimit: 1024 ^ 100,
-		// BodyLimit: 1024 * 1024 * 1024 * 1024 * 1024,
-		BodyLimit: int(math.Pow(1024, 10)),
+		BodyLimit:             bodyLimit,
+		DisableStartupMessage: true,
+	})
+
+	// Requests run in a context that is cancelled once shutdown stops waiting for them, which
+	// aborts uploads still being written
+	transfers, abortTransfers := context.WithCancel(context.Background())
+	app.Use(func(c *fiber.Ctx) error {
+		c.SetUserContext(transfers)
+		return c.Next()
 	})
 
 	// Middleware
-	app.Use(logger.New())
+	app.Use(tracing.Middleware())
+	app.Use(logging.RequestID())
+	app.Use(logging.AccessLog())
+	if cfg.Server.MetricsEnabled {
+		app.Use(metrics.Middleware())
+	}
+	// Origins are checked per request so SIGHUP can change them, preflights are cached for CORS_MAX_AGE
 	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "http://localhost:5173, http://localhost:3000, http://127.0.0.1:5173, http://127.0.0.1:3000, https://planarshare.com", // TODO: change to the actual domain
-		AllowMethods:     "GET, POST, PUT, DELETE, OPTIONS",
-		AllowHeaders:     "Origin, Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-Requested-With",
-		AllowCredentials: true,
+		AllowOriginsFunc: utils.AllowOrigin,
+		AllowMethods:     strings.ToUpper(strings.Join(cfg.Server.CORSMethods, ", ")),
+		AllowHeaders:     strings.Join(cfg.Server.CORSHeaders, ", "),
+		AllowCredentials: cfg.Server.CORSAllowCredentials,
+		MaxAge:           int(cfg.Server.CORSMaxAge.Seconds()),
 	}))
 
 	// Main API routes
-	app.Post("/up/:signature", handlers.UploadHandler(cfg.Storage.FilesDirectory))
-	app.Get("/d/f/:fileID", handlers.DownloadFileHandler(cfg.Storage.FilesDirectory))
-	app.Get("/d/s/:shareID", handlers.DownloadShareHandler(cfg.Storage.FilesDirectory))
+	app.Post("/up/:signature", handlers.UploadHandler(store, uploadPolicy))
+	app.Get("/d/f/:fileID", handlers.DownloadFileHandler(store))
+	app.Get("/d/f/:fileID/entries", handlers.ArchiveEntriesHandler(store))
+	app.Get("/d/f/:fileID/entry", handlers.ArchiveEntryHandler(store))
+	app.Get("/p/f/:fileID", handlers.PreviewFileHandler(store))
+	app.Get("/d/s/:shareID", handlers.DownloadShareHandler(store))
+	app.Get("/d/s/:shareID/files", handlers.DownloadSelectionHandler(store))
+	app.Post("/d/s/:shareID/files", handlers.DownloadSelectionHandler(store))
+	app.Get("/v/s/:shareID", handlers.ShareVisitHandler)
+	app.Get("/api/shares/:shareID", handlers.ShareManifestHandler)
+	app.Get("/api/shares/:shareID/files", handlers.ShareFilesHandler)
+	app.Get("/api/shares/:shareID/tree", handlers.ShareTreeHandler)
+
+	// Management API, used by the SvelteKit backend
+	if cfg.Server.ManagementToken != "" || cfg.Server.ManagementAdminToken != "" {
+		auth := []fiber.Handler{handlers.ManagementAuth(cfg.Server.ManagementToken, cfg.Server.ManagementAdminToken)}
+		if cfg.TLS.ClientCAFile != "" {
+			auth = append([]fiber.Handler{handlers.RequireClientCert()}, auth...)
+		}
+		manage := app.Group("/api/manage", auth...)
+		manage.Get("/audit", handlers.AuditLogHandler)
+		manage.Delete("/files/:fileID", handlers.DeleteFileHandler)
+		manage.Delete("/shares/:shareID", handlers.DeleteShareHandler)
+		manage.Get("/shares/:shareID", handlers.ManagedShareManifestHandler)
+		manage.Get("/shares/:shareID/files", handlers.ManagedShareFilesHandler)
+		manage.Get("/shares/:shareID/tree", handlers.ManagedShareTreeHandler)
+		manage.Get("/shares/:shareID/analytics", handlers.ShareAnalyticsHandler)
+		manage.Delete("/shares/:shareID/analytics", handlers.DeleteShareAnalyticsHandler)
+	} else {
+		slog.Warn("MANAGEMENT_API_TOKEN and MANAGEMENT_ADMIN_TOKEN are not set, management API disabled")
+	}
 
 	// Development and testing routes
 	app.Post("/api/generate-signature", handlers.GenerateUploadSignatureHandler)
 	app.Post("/api/create-test-share", handlers.CreateTestShareHandler)
 
-	// Health check
+	// Prometheus metrics
+	if cfg.Server.MetricsEnabled {
+		sqlDB, err := database.DB.DB()
+		if err != nil {
+			logging.Fatal("Failed to get database pool", "error", err)
+		}
+		metrics.Register(sqlDB, store)
+		app.Get("/metrics", metrics.Handler(cfg.Server.MetricsToken))
+		if cfg.Server.MetricsToken == "" {
+			slog.Warn("METRICS_TOKEN is not set, /metrics is public")
+		}
+	}
+
+	// Health checks: liveness on / and /healthz, readiness on /readyz
 	app.Get("/", handlers.HealthHandler)
+	app.Get("/healthz", handlers.HealthHandler)
+	app.Get("/readyz", handlers.ReadinessHandler(store, cfg.Health))
 
 	// Start server
-	log.Printf("Server starting on port %s", cfg.Server.Port)
-	log.Printf("Available endpoints:")
-	log.Printf("  POST /up/:signature             - Upload files")
-	log.Printf("  GET  /d/f/:fileID               - Download file")
-	log.Printf("  GET  /d/s/:shareID              - Download share")
-	log.Printf("  POST /api/generate-signature    - Generate upload signature")
-	log.Printf("  POST /api/create-test-share     - Create test share")
-	log.Printf("  GET  /                          - Health check")
-	log.Fatal(app.Listen(":" + cfg.Server.Port))
+	for _, route := range app.GetRoutes(true) {
+		slog.Debug("Route registered", "method", route.Method, "path", route.Path)
+	}
+	slog.Info("Server starting", "port", cfg.Server.Port, "tls", certs != nil)
+
+	ln, err := server.Listen(cfg.Server.Port, certs, "http/1.1")
+	if err != nil {
+		logging.Fatal("Failed to listen", "error", err)
+	}
+	go func() {
+		if err := app.Listener(ln); err != nil {
+			logging.Fatal("Server stopped", "error", err)
+		}
+	}()
+
+	// HTTP/2 listener for clients running many parallel downloads
+	var http2Server *http.Server
+	if cfg.TLS.HTTP2Port != 0 {
+		http2Server = server.NewHTTP2Server(app, bodyLimit)
+		slog.Info("HTTP/2 server starting", "port", cfg.TLS.HTTP2Port)
+		go func() {
+			if err := server.ServeHTTP2(http2Server, strconv.Itoa(cfg.TLS.HTTP2Port), certs); err != nil {
+				logging.Fatal("HTTP/2 server stopped", "error", err)
+			}
+		}()
+	}
+
+	// Reload the settings that are safe to change while serving on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloadConfig(cfg, args, uploadPolicy)
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					slog.Error("Failed to reload TLS certificate, keeping the current one", "error", err)
+				}
+			}
+		}
+	}()
+
+	// Wait for a shutdown signal, then stop accepting connections and let in-flight transfers finish
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+
+	slog.Info("Shutting down, waiting for in-flight transfers", "timeout", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	http2Done := make(chan error, 1)
+	go func() {
+		if http2Server == nil {
+			http2Done <- nil
+			return
+		}
+		http2Done <- http2Server.Shutdown(shutdownCtx)
+	}()
+	err = errors.Join(app.ShutdownWithContext(shutdownCtx), <-http2Done)
+	if err != nil {
+		slog.Warn("Transfers still in flight after the shutdown timeout, aborting them", "error", err)
+	}
+	cancelShutdown()
+	abortTransfers()
+
+	// Clean up aborted uploads, flush queued analytics and close the database pool
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := store.Drain(ctx); err != nil {
+		slog.Error("Failed to finish uploads", "error", err)
+	}
+	if err := analytics.Close(ctx); err != nil {
+		slog.Error("Failed to flush analytics", "error", err)
+	}
+	if sqlDB, err := database.DB.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			slog.Error("Failed to close database pool", "error", err)
+		}
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+}
+
+// loadConfig loads and validates the configuration, exiting with every problem found if it is invalid
+func loadConfig(args []string) *config.Config {
+	cfg, err := config.Load(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// printConfig implements `config print [--redacted]`, writing the effective configuration as YAML
+func printConfig(args []string) {
+	redacted := false
+	var flags []string
+	for _, arg := range args {
+		if arg == "--redacted" || arg == "-redacted" {
+			redacted = true
+		} else {
+			flags = append(flags, arg)
+		}
+	}
+
+	cfg := loadConfig(flags)
+	if redacted {
+		cfg = cfg.Redacted()
+	}
+	if err := cfg.Print(os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to print configuration: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// reloadConfig applies the reloadable settings of a freshly loaded configuration. The current
+// configuration is kept if the new one is invalid, and changes that need a restart are reported.
+func reloadConfig(started *config.Config, args []string, uploadPolicy *policy.Defaults) {
+	next, err := config.Load(args)
+	if err != nil {
+		slog.Error("Invalid configuration, keeping the current one", "error", err)
+		return
+	}
+
+	if err := utils.SetTrustedProxies(next.Server.TrustedProxies); err != nil {
+		slog.Error("Invalid TRUSTED_PROXIES, keeping the current ones", "error", err)
+	}
+	if err := utils.SetAllowedOrigins(next.Server.CORSOrigins); err != nil {
+		slog.Error("Invalid CORS_ORIGINS, keeping the current ones", "error", err)
+	}
+	if err := logging.SetLevel(next.Server.LogLevel); err != nil {
+		slog.Error("Invalid LOG_LEVEL, keeping the current one", "error", err)
+	}
+	// MAX_FILE_SIZE also sets the body limit the server was started with, so it needs a restart
+	upload := next.Upload
+	upload.MaxFileSize = started.Upload.MaxFileSize
+	uploadPolicy.Update(upload)
+
+	if changed := started.RestartRequired(next); len(changed) > 0 {
+		slog.Warn("Changed settings take effect after a restart", "settings", changed)
+	}
+	slog.Info("Configuration reloaded")
 }
@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"planarcomputer/pss-fs/analytics"
+	"planarcomputer/pss-fs/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes every metric name
+const namespace = "pssfs"
+
+// Transfer directions for the active transfers gauge
+const (
+	DirectionUpload   = "upload"
+	DirectionDownload = "download"
+)
+
+var (
+	requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent handling HTTP requests by method and route, excluding streamed response bodies.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	uploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "uploaded_bytes_total",
+		Help:      "Bytes of files accepted by uploads.",
+	})
+
+	downloadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Bytes of response bodies sent by downloads.",
+	})
+
+	activeTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_transfers",
+		Help:      "Uploads being processed and downloads being sent.",
+	}, []string{"direction"})
+
+	zipBuildDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "zip_build_duration_seconds",
+		Help:      "Time spent building zip archives of shares.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	})
+
+	signatureValidations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "signature_validations_total",
+		Help:      "Upload signature validations by outcome and rejection reason.",
+	}, []string{"outcome", "reason"})
+
+	uploadRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_rejections_total",
+		Help:      "Uploads rejected by the upload policy and plan limits, or for other reasons, by reason.",
+	}, []string{"reason"})
+)
+
+// Register adds the collectors reading live state: the database pool, free storage space and the
+// analytics pipeline
+func Register(db *sql.DB, store *storage.Store) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, namespace))
+
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "storage_free_bytes",
+		Help:      "Bytes available on the filesystem of the files directory.",
+	}, func() float64 {
+		free, err := store.FreeSpace()
+		if err != nil {
+			return -1
+		}
+		return float64(free)
+	}))
+
+	analyticsCounter := func(name, help string, value func(analytics.Stats) uint64) {
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "analytics",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(analytics.GetStats())) }))
+	}
+	analyticsCounter("events_enqueued_total", "Analytics events accepted into the queue.", func(s analytics.Stats) uint64 { return s.Enqueued })
+	analyticsCounter("events_written_total", "Analytics events written to the database.", func(s analytics.Stats) uint64 { return s.Written })
+	analyticsCounter("events_dropped_total", "Analytics events dropped because the queue was full.", func(s analytics.Stats) uint64 { return s.Dropped })
+	analyticsCounter("events_failed_total", "Analytics events lost to database errors.", func(s analytics.Stats) uint64 { return s.Failed })
+	analyticsCounter("backpressure_total", "Times a request found the analytics queue full and had to wait.", func(s analytics.Stats) uint64 { return s.Backpressure })
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "analytics",
+		Name:      "queue_depth",
+		Help:      "Analytics events waiting to be written.",
+	}, func() float64 { return float64(analytics.GetStats().QueueDepth) }))
+}
+
+// Handler serves the metrics in the Prometheus text format, requiring token as a bearer token when set
+func Handler(token string) fiber.Handler {
+	serve := adaptor.HTTPHandler(promhttp.Handler())
+	return func(c *fiber.Ctx) error {
+		if token != "" {
+			provided, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+				return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+			}
+		}
+		return serve(c)
+	}
+}
+
+// Middleware counts and times requests by their route pattern, so IDs in paths don't create series
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+
+		// Unmatched requests end on the catch-all route of this middleware
+		route := c.Route().Path
+		if route == "/" && c.Path() != "/" {
+			route = "unmatched"
+		}
+
+		requests.WithLabelValues(c.Method(), route, strconv.Itoa(status)).Inc()
+		requestDuration.WithLabelValues(c.Method(), route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// StartUpload marks an upload as in progress, the returned function marks it done
+func StartUpload() func() {
+	activeTransfers.WithLabelValues(DirectionUpload).Inc()
+	return func() { activeTransfers.WithLabelValues(DirectionUpload).Dec() }
+}
+
+// AddUploadedBytes counts the bytes of an accepted file
+func AddUploadedBytes(n int64) {
+	uploadedBytes.Add(float64(n))
+}
+
+// ObserveZipBuild records how long building a zip archive took
+func ObserveZipBuild(d time.Duration) {
+	zipBuildDuration.Observe(d.Seconds())
+}
+
+// SignatureValidated counts an upload signature accepted
+func SignatureValidated() {
+	signatureValidations.WithLabelValues("success", "").Inc()
+}
+
+// SignatureRejected counts an upload signature rejected for reason
+func SignatureRejected(reason string) {
+	signatureValidations.WithLabelValues("failure", reason).Inc()
+}
+
+// UploadRejected counts an upload rejected for reason, e.g. a policy violation code
+func UploadRejected(reason string) {
+	uploadRejections.WithLabelValues(reason).Inc()
+}
+
+// Download wraps a response body, counting the bytes sent and the download as active until
+// fasthttp closes it
+func Download(r io.ReadCloser) io.ReadCloser {
+	activeTransfers.WithLabelValues(DirectionDownload).Inc()
+	return &downloadBody{ReadCloser: r}
+}
+
+type downloadBody struct {
+	io.ReadCloser
+	closed atomic.Bool
+}
+
+func (b *downloadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	downloadedBytes.Add(float64(n))
+	return n, err
+}
+
+func (b *downloadBody) Close() error {
+	if !b.closed.Swap(true) {
+		activeTransfers.WithLabelValues(DirectionDownload).Dec()
+	}
+	return b.ReadCloser.Close()
+}
@@ -14,6 +14,14 @@ type PsPlans struct {
 	PolarId  *string `json:"polar_id" gorm:"column:polar_id;size:255"`
 	PlanName string  `json:"plan_name" gorm:"column:plan_name;size:100;not null"`
 	Quota    int64   `json:"quota" gorm:"not null"` // in MB
+
+	// Upload policy overrides, NULL falls back to the service defaults
+	MaxFileSize       *int64  `json:"max_file_size" gorm:"column:max_file_size"` // in bytes
+	MaxFilesPerShare  *int    `json:"max_files_per_share" gorm:"column:max_files_per_share"`
+	AllowedMimetypes  *string `json:"allowed_mimetypes" gorm:"column:allowed_mimetypes;type:text"` // comma-separated
+	BlockedMimetypes  *string `json:"blocked_mimetypes" gorm:"column:blocked_mimetypes;type:text"`
+	AllowedExtensions *string `json:"allowed_extensions" gorm:"column:allowed_extensions;type:text"`
+	BlockedExtensions *string `json:"blocked_extensions" gorm:"column:blocked_extensions;type:text"`
 }
 
 func (PsPlans) TableName() string {
@@ -35,6 +43,24 @@ func (PsUsers) TableName() string {
 	return "ps_users"
 }
 
+// PsUserPlan represents the ps_user_plan table
+type PsUserPlan struct {
+	UserId         uuid.UUID  `json:"user_id" gorm:"type:uuid;primaryKey;constraint:OnDelete:CASCADE"`
+	PlanId         int        `json:"plan_id" gorm:"column:plan_id;default:1;not null"`
+	CreatedAt      time.Time  `json:"created_at" gorm:"column:created_at;default:CURRENT_TIMESTAMP"`
+	UpdatedAt      time.Time  `json:"updated_at" gorm:"column:updated_at;default:CURRENT_TIMESTAMP"`
+	ExpiresAt      *time.Time `json:"expires_at" gorm:"column:expires_at"`
+	SubscriptionId *string    `json:"subscription_id" gorm:"column:subscription_id;size:255"`
+
+	// Relationships
+	User PsUsers `gorm:"foreignKey:UserId;references:ID"`
+	Plan PsPlans `gorm:"foreignKey:PlanId;references:ID"`
+}
+
+func (PsUserPlan) TableName() string {
+	return "ps_user_plan"
+}
+
 // PsUsedQuota represents the ps_used_quota table
 type PsUsedQuota struct {
 	UserId      uuid.UUID `json:"user_id" gorm:"type:uuid;primaryKey;constraint:OnDelete:CASCADE"`
@@ -85,14 +111,52 @@ type PsFiles struct {
 	Hash      string     `json:"hash" gorm:"size:255;not null"`
 	Size      int64      `json:"size" gorm:"not null"`
 
+	// Folder of the file within the share, /-separated, NULL for files at the root
+	RelativePath *string `json:"relative_path" gorm:"column:relative_path;size:1024"`
+
+	// End-to-end encrypted files hold client-side ciphertext the server cannot read,
+	// their real name and mimetype live in the client-encrypted metadata blob
+	IsE2ee            bool    `json:"is_e2ee" gorm:"column:is_e2ee;default:false;not null"`
+	EncryptedMetadata *string `json:"encrypted_metadata,omitempty" gorm:"column:encrypted_metadata;type:text"`
+
+	// Encryption at rest, all NULL for blobs stored in plaintext
+	EncryptionKeyId     *string `json:"-" gorm:"column:encryption_key_id;size:64"`
+	EncryptedDataKey    *string `json:"-" gorm:"column:encrypted_data_key;size:255"`
+	EncryptionNonce     *string `json:"-" gorm:"column:encryption_nonce;size:64"`
+	EncryptionChunkSize *int    `json:"-" gorm:"column:encryption_chunk_size"`
+
 	// Relationships
 	Share PsShares `gorm:"foreignKey:ShareId;references:ID"`
 }
 
+// IsEncrypted reports whether the file's blob is encrypted at rest
+func (f *PsFiles) IsEncrypted() bool {
+	return f.EncryptedDataKey != nil
+}
+
 func (PsFiles) TableName() string {
 	return "ps_files"
 }
 
+// PsShareSettings represents the ps_share_settings table
+type PsShareSettings struct {
+	ID            uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	ShareId       uuid.UUID  `json:"share_id" gorm:"column:share_id;type:uuid;uniqueIndex;not null;constraint:OnDelete:CASCADE"`
+	Expiry        *time.Time `json:"expiry" gorm:"column:expiry"`
+	PasswordHash  *string    `json:"-" gorm:"column:password_hash;size:255"`
+	DownloadLimit *int       `json:"download_limit" gorm:"column:download_limit"`
+	CustomSlug    *string    `json:"custom_slug" gorm:"column:custom_slug;size:255;uniqueIndex"`
+	CreatedAt     time.Time  `json:"created_at" gorm:"column:created_at;default:CURRENT_TIMESTAMP"`
+	UpdatedAt     time.Time  `json:"updated_at" gorm:"column:updated_at;default:CURRENT_TIMESTAMP"`
+
+	// Relationships
+	Share PsShares `gorm:"foreignKey:ShareId;references:ID"`
+}
+
+func (PsShareSettings) TableName() string {
+	return "ps_share_settings"
+}
+
 // PsUploadSignatures represents the ps_upload_signatures table
 type PsUploadSignatures struct {
 	ID                uuid.UUID  `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
@@ -123,6 +187,9 @@ type PsDownloadAnalytics struct {
 	UserAgent *string    `json:"user_agent" gorm:"column:user_agent;size:512"`
 	Country   *string    `json:"country" gorm:"size:2"`
 	City      *string    `json:"city" gorm:"size:100"`
+	// Bytes of the response body sent, and whether that completed the transfer
+	BytesSent *int64  `json:"bytes_sent" gorm:"column:bytes_sent"`
+	Status    *string `json:"status" gorm:"size:16"`
 
 	// Relationships
 	Share PsShares `gorm:"foreignKey:ShareId;references:ID"`
@@ -143,6 +210,8 @@ type PsVisitAnalytics struct {
 	Referrer  *string   `json:"referrer" gorm:"size:512"`
 	Country   *string   `json:"country" gorm:"size:2"`
 	City      *string   `json:"city" gorm:"size:100"`
+	// Keyed hash of the visitor, used to deduplicate repeat visits
+	VisitorHash *string `json:"-" gorm:"column:visitor_hash;size:64"`
 
 	// Relationships
 	Share PsShares `gorm:"foreignKey:ShareId;references:ID"`
@@ -151,3 +220,66 @@ type PsVisitAnalytics struct {
 func (PsVisitAnalytics) TableName() string {
 	return "ps_visit_analytics"
 }
+
+// PsAuditLog represents the ps_audit_log table, an append-only record of security-relevant events.
+// It deliberately has no foreign keys so entries outlive the users, shares and files they mention.
+type PsAuditLog struct {
+	ID          uuid.UUID              `json:"id" gorm:"type:uuid;primaryKey;default:gen_random_uuid()"`
+	Timestamp   time.Time              `json:"timestamp" gorm:"default:CURRENT_TIMESTAMP;not null;index"`
+	Event       string                 `json:"event" gorm:"size:64;not null;index"`
+	Outcome     string                 `json:"outcome" gorm:"size:16;not null"`
+	ActorUserId *uuid.UUID             `json:"actor_user_id" gorm:"column:actor_user_id;type:uuid;index"`
+	Actor       *string                `json:"actor" gorm:"size:255"`
+	ShareId     *uuid.UUID             `json:"share_id" gorm:"column:share_id;type:uuid;index"`
+	FileId      *uuid.UUID             `json:"file_id" gorm:"column:file_id;type:uuid"`
+	IpAddress   *string                `json:"ip_address" gorm:"column:ip_address;size:45"`
+	UserAgent   *string                `json:"user_agent" gorm:"column:user_agent;size:512"`
+	Reason      *string                `json:"reason" gorm:"size:255"`
+	Details     map[string]interface{} `json:"details" gorm:"type:jsonb;serializer:json"`
+}
+
+func (PsAuditLog) TableName() string {
+	return "ps_audit_log"
+}
+
+// PsAnalyticsHourly represents the ps_analytics_hourly table, per-share download and visit counts
+// rolled up by hour from the raw analytics tables. It is rebuilt by pss-fs and has no foreign keys.
+type PsAnalyticsHourly struct {
+	ShareId        uuid.UUID `json:"share_id" gorm:"column:share_id;type:uuid;primaryKey"`
+	Bucket         time.Time `json:"bucket" gorm:"primaryKey;index"`
+	Downloads      int64     `json:"downloads" gorm:"not null;default:0"`
+	Visits         int64     `json:"visits" gorm:"not null;default:0"`
+	UniqueVisitors int64     `json:"unique_visitors" gorm:"column:unique_visitors;not null;default:0"`
+}
+
+func (PsAnalyticsHourly) TableName() string {
+	return "ps_analytics_hourly"
+}
+
+// PsAnalyticsDaily represents the ps_analytics_daily table, per-share daily totals (dimension
+// 'total') and breakdowns by file, referrer host and country rolled up from the raw analytics tables
+type PsAnalyticsDaily struct {
+	ShareId        uuid.UUID `json:"share_id" gorm:"column:share_id;type:uuid;primaryKey"`
+	Day            time.Time `json:"day" gorm:"type:date;primaryKey;index"`
+	Dimension      string    `json:"dimension" gorm:"size:16;primaryKey"`
+	Value          string    `json:"value" gorm:"size:512;primaryKey"`
+	Downloads      int64     `json:"downloads" gorm:"not null;default:0"`
+	Visits         int64     `json:"visits" gorm:"not null;default:0"`
+	UniqueVisitors int64     `json:"unique_visitors" gorm:"column:unique_visitors;not null;default:0"`
+}
+
+func (PsAnalyticsDaily) TableName() string {
+	return "ps_analytics_daily"
+}
+
+// PsSchemaVersion represents the ps_schema_version table, recording the version of the service
+// tables each component has migrated to
+type PsSchemaVersion struct {
+	Component  string    `json:"component" gorm:"size:64;primaryKey"`
+	Version    int       `json:"version" gorm:"not null"`
+	MigratedAt time.Time `json:"migrated_at" gorm:"column:migrated_at;not null;default:CURRENT_TIMESTAMP"`
+}
+
+func (PsSchemaVersion) TableName() string {
+	return "ps_schema_version"
+}
@@ -0,0 +1,306 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"planarcomputer/pss-fs/config"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/models"
+	"planarcomputer/pss-fs/utils"
+
+	"github.com/google/uuid"
+)
+
+// Violation codes returned to clients when an upload is rejected
+const (
+	CodeFileTooLarge        = "file_too_large"
+	CodeTooManyFiles        = "too_many_files"
+	CodeMimetypeNotAllowed  = "mimetype_not_allowed"
+	CodeMimetypeBlocked     = "mimetype_blocked"
+	CodeExtensionNotAllowed = "extension_not_allowed"
+	CodeExtensionBlocked    = "extension_blocked"
+)
+
+// MultipartOverhead is the allowance for multipart framing and form fields on top of the file itself
+const MultipartOverhead = 1 << 20
+
+// Policy describes what may be uploaded into a share. Allowlists are nil when anything is
+// allowed, an empty allowlist allows nothing.
+type Policy struct {
+	MaxFileSize       int64 // in bytes, 0 means unlimited
+	MaxFilesPerShare  int   // 0 means unlimited
+	AllowedMimetypes  []string
+	BlockedMimetypes  []string
+	AllowedExtensions []string
+	BlockedExtensions []string
+}
+
+// Violation describes why an upload was rejected
+type Violation struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// New creates the service-wide default policy from configuration
+func New(cfg config.UploadConfig) *Policy {
+	return &Policy{
+		MaxFileSize:       int64(cfg.MaxFileSize),
+		MaxFilesPerShare:  cfg.MaxFilesPerShare,
+		AllowedMimetypes:  normalizeMimetypes(cfg.AllowedMimetypes),
+		BlockedMimetypes:  normalizeMimetypes(cfg.BlockedMimetypes),
+		AllowedExtensions: normalizeExtensions(cfg.AllowedExtensions),
+		BlockedExtensions: normalizeExtensions(cfg.BlockedExtensions),
+	}
+}
+
+// Defaults holds the service-wide default policy, which is replaced when the configuration is reloaded
+type Defaults struct {
+	current atomic.Pointer[Policy]
+}
+
+// NewDefaults creates the service-wide default policy from configuration
+func NewDefaults(cfg config.UploadConfig) *Defaults {
+	d := &Defaults{}
+	d.Update(cfg)
+	return d
+}
+
+// Update replaces the default policy, uploads already being checked keep the previous one
+func (d *Defaults) Update(cfg config.UploadConfig) {
+	d.current.Store(New(cfg))
+}
+
+// ForShare returns the policy for uploads into a share based on the current defaults
+func (d *Defaults) ForShare(ctx context.Context, shareID uuid.UUID) (*Policy, error) {
+	return d.current.Load().ForShare(ctx, shareID)
+}
+
+// ForShare returns the policy for uploads into a share, applying the owner's plan overrides.
+// Plans may tighten the size limits but never raise them above the service-wide maximum, and
+// their allowlists only allow what the service-wide allowlists do too.
+func (p *Policy) ForShare(ctx context.Context, shareID uuid.UUID) (*Policy, error) {
+	var plans []models.PsPlans
+	result := database.DB.WithContext(ctx).Raw(`
+		SELECT p.*
+		FROM ps_plans p
+		JOIN ps_user_plan up ON up.plan_id = p.id
+		JOIN ps_shares s ON s.user_id = up.user_id
+		WHERE s.id = ? AND (up.expires_at IS NULL OR up.expires_at > NOW())
+		LIMIT 1
+	`, shareID).Scan(&plans)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to load plan for share %s: %w", shareID, result.Error)
+	}
+
+	if len(plans) == 0 {
+		effective := *p
+		return &effective, nil
+	}
+	return p.withPlan(&plans[0]), nil
+}
+
+// withPlan returns the policy with a plan's overrides applied. A plan limit of 0 means unlimited
+// like the defaults, so it is no override, as it could otherwise only loosen the limit.
+func (p *Policy) withPlan(plan *models.PsPlans) *Policy {
+	effective := *p
+	if plan.MaxFileSize != nil && *plan.MaxFileSize > 0 && (effective.MaxFileSize == 0 || *plan.MaxFileSize < effective.MaxFileSize) {
+		effective.MaxFileSize = *plan.MaxFileSize
+	}
+	if plan.MaxFilesPerShare != nil && *plan.MaxFilesPerShare > 0 && (effective.MaxFilesPerShare == 0 || *plan.MaxFilesPerShare < effective.MaxFilesPerShare) {
+		effective.MaxFilesPerShare = *plan.MaxFilesPerShare
+	}
+	if plan.AllowedMimetypes != nil {
+		effective.AllowedMimetypes = intersectMimetypes(normalizeMimetypes(splitList(*plan.AllowedMimetypes)), p.AllowedMimetypes)
+	}
+	if plan.BlockedMimetypes != nil {
+		effective.BlockedMimetypes = append(normalizeMimetypes(splitList(*plan.BlockedMimetypes)), p.BlockedMimetypes...)
+	}
+	if plan.AllowedExtensions != nil {
+		effective.AllowedExtensions = intersectExtensions(normalizeExtensions(splitList(*plan.AllowedExtensions)), p.AllowedExtensions)
+	}
+	if plan.BlockedExtensions != nil {
+		effective.BlockedExtensions = append(normalizeExtensions(splitList(*plan.BlockedExtensions)), p.BlockedExtensions...)
+	}
+	return &effective
+}
+
+// CheckRequestSize rejects a request whose declared body is larger than any permitted file,
+// so oversized uploads are refused before the multipart body is parsed or spooled to disk
+func (p *Policy) CheckRequestSize(contentLength int64) *Violation {
+	if p.MaxFileSize > 0 && contentLength > p.MaxFileSize+MultipartOverhead {
+		return p.fileTooLarge()
+	}
+	return nil
+}
+
+// CheckFileCount rejects an upload that would take a share past its file limit
+func (p *Policy) CheckFileCount(currentCount int) *Violation {
+	if p.MaxFilesPerShare > 0 && currentCount+1 > p.MaxFilesPerShare {
+		return &Violation{
+			Status:  400,
+			Code:    CodeTooManyFiles,
+			Message: fmt.Sprintf("Shares may contain at most %d files", p.MaxFilesPerShare),
+		}
+	}
+	return nil
+}
+
+// CheckFileSize validates a single file's size
+func (p *Policy) CheckFileSize(size int64) *Violation {
+	if p.MaxFileSize > 0 && size > p.MaxFileSize {
+		return p.fileTooLarge()
+	}
+	return nil
+}
+
+// CheckFile validates a single file's size, extension and detected mimetype
+func (p *Policy) CheckFile(fileName, mimetype string, size int64) *Violation {
+	if violation := p.CheckFileSize(size); violation != nil {
+		return violation
+	}
+
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if containsExtension(p.BlockedExtensions, ext) {
+		return &Violation{Status: 415, Code: CodeExtensionBlocked, Message: fmt.Sprintf("Files with extension '%s' are not allowed", ext)}
+	}
+	if p.AllowedExtensions != nil && !containsExtension(p.AllowedExtensions, ext) {
+		return &Violation{Status: 415, Code: CodeExtensionNotAllowed, Message: fmt.Sprintf("Files with extension '%s' are not allowed", ext)}
+	}
+
+	base := utils.BaseMimetype(mimetype)
+	if matchesMimetype(p.BlockedMimetypes, base) {
+		return &Violation{Status: 415, Code: CodeMimetypeBlocked, Message: fmt.Sprintf("Files of type '%s' are not allowed", base)}
+	}
+	if p.AllowedMimetypes != nil && !matchesMimetype(p.AllowedMimetypes, base) {
+		return &Violation{Status: 415, Code: CodeMimetypeNotAllowed, Message: fmt.Sprintf("Files of type '%s' are not allowed", base)}
+	}
+
+	return nil
+}
+
+func (p *Policy) fileTooLarge() *Violation {
+	return &Violation{
+		Status:  413,
+		Code:    CodeFileTooLarge,
+		Message: fmt.Sprintf("Files may be at most %d bytes", p.MaxFileSize),
+	}
+}
+
+// matchesMimetype reports whether mimetype matches any pattern, where "type/*" matches a whole type
+func matchesMimetype(patterns []string, mimetype string) bool {
+	for _, pattern := range patterns {
+		if pattern == mimetype || pattern == "*/*" {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mimetype, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectMimetypes returns the patterns allowed by both allowlists, keeping the narrower of two
+// overlapping patterns, so "image/*" and "image/png" allow only "image/png"
+func intersectMimetypes(plan, global []string) []string {
+	if plan == nil {
+		return global
+	}
+	if global == nil {
+		return plan
+	}
+	allowed := make([]string, 0)
+	for _, a := range plan {
+		for _, b := range global {
+			switch {
+			case matchesMimetype([]string{b}, a):
+				allowed = appendUnique(allowed, a)
+			case matchesMimetype([]string{a}, b):
+				allowed = appendUnique(allowed, b)
+			}
+		}
+	}
+	return allowed
+}
+
+// intersectExtensions returns the extensions allowed by both allowlists
+func intersectExtensions(plan, global []string) []string {
+	if plan == nil {
+		return global
+	}
+	if global == nil {
+		return plan
+	}
+	allowed := make([]string, 0)
+	for _, ext := range plan {
+		if containsExtension(global, ext) {
+			allowed = appendUnique(allowed, ext)
+		}
+	}
+	return allowed
+}
+
+func appendUnique(list []string, item string) []string {
+	if slices.Contains(list, item) {
+		return list
+	}
+	return append(list, item)
+}
+
+func containsExtension(extensions []string, ext string) bool {
+	for _, e := range extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeMimetypes(mimetypes []string) []string {
+	if len(mimetypes) == 0 {
+		return nil
+	}
+	normalized := make([]string, 0, len(mimetypes))
+	for _, m := range mimetypes {
+		normalized = append(normalized, strings.ToLower(strings.TrimSpace(m)))
+	}
+	return normalized
+}
+
+// normalizeExtensions lowercases extensions and ensures they have a leading dot.
+// An empty entry or "." matches files without an extension.
+func normalizeExtensions(extensions []string) []string {
+	if len(extensions) == 0 {
+		return nil
+	}
+	normalized := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "." {
+			ext = ""
+		} else if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		normalized = append(normalized, ext)
+	}
+	return normalized
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,115 @@
+package policy
+
+import (
+	"slices"
+	"testing"
+
+	"planarcomputer/pss-fs/models"
+)
+
+func TestIntersectMimetypes(t *testing.T) {
+	tests := []struct {
+		name         string
+		plan, global []string
+		want         []string
+	}{
+		{"no global allowlist", []string{"image/*"}, nil, []string{"image/*"}},
+		{"no plan allowlist", nil, []string{"image/*"}, []string{"image/*"}},
+		{"same", []string{"image/png"}, []string{"image/png"}, []string{"image/png"}},
+		{"plan wider", []string{"image/*"}, []string{"image/png", "text/plain"}, []string{"image/png"}},
+		{"plan narrower", []string{"image/png", "video/mp4"}, []string{"image/*"}, []string{"image/png"}},
+		{"plan allows everything", []string{"*/*"}, []string{"image/*"}, []string{"image/*"}},
+		{"disjoint", []string{"video/*"}, []string{"image/*"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := intersectMimetypes(tt.plan, tt.global)
+			if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("intersectMimetypes(%q, %q) = %#v, want %#v", tt.plan, tt.global, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntersectExtensions(t *testing.T) {
+	tests := []struct {
+		name         string
+		plan, global []string
+		want         []string
+	}{
+		{"no global allowlist", []string{".pdf"}, nil, []string{".pdf"}},
+		{"no plan allowlist", nil, []string{".pdf"}, []string{".pdf"}},
+		{"overlap", []string{".pdf", ".exe"}, []string{".pdf", ".txt"}, []string{".pdf"}},
+		{"disjoint", []string{".exe"}, []string{".pdf"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := intersectExtensions(tt.plan, tt.global)
+			if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("intersectExtensions(%q, %q) = %#v, want %#v", tt.plan, tt.global, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		fileName string
+		mimetype string
+		size     int64
+		wantCode string
+	}{
+		{"no limits", Policy{}, "a.exe", "application/octet-stream", 1 << 30, ""},
+		{"too large", Policy{MaxFileSize: 10}, "a.txt", "text/plain", 11, CodeFileTooLarge},
+		{"allowed mimetype", Policy{AllowedMimetypes: []string{"image/*"}}, "a.png", "image/png", 1, ""},
+		{"mimetype not allowed", Policy{AllowedMimetypes: []string{"image/*"}}, "a.txt", "text/plain; charset=utf-8", 1, CodeMimetypeNotAllowed},
+		{"empty mimetype allowlist", Policy{AllowedMimetypes: []string{}}, "a.png", "image/png", 1, CodeMimetypeNotAllowed},
+		{"mimetype blocked", Policy{BlockedMimetypes: []string{"text/html"}}, "a.htm", "text/html", 1, CodeMimetypeBlocked},
+		{"extension not allowed", Policy{AllowedExtensions: []string{".pdf"}}, "a.PNG", "image/png", 1, CodeExtensionNotAllowed},
+		{"empty extension allowlist", Policy{AllowedExtensions: []string{}}, "a.pdf", "application/pdf", 1, CodeExtensionNotAllowed},
+		{"extension blocked", Policy{BlockedExtensions: []string{".exe"}}, "a.EXE", "application/octet-stream", 1, CodeExtensionBlocked},
+		{"no extension allowed", Policy{AllowedExtensions: normalizeExtensions([]string{"."})}, "README", "text/plain", 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violation := tt.policy.CheckFile(tt.fileName, tt.mimetype, tt.size)
+			var code string
+			if violation != nil {
+				code = violation.Code
+			}
+			if code != tt.wantCode {
+				t.Errorf("CheckFile(%q, %q, %d) = %q, want %q", tt.fileName, tt.mimetype, tt.size, code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWithPlanLimits(t *testing.T) {
+	size := func(n int64) *int64 { return &n }
+	count := func(n int) *int { return &n }
+
+	tests := []struct {
+		name         string
+		defaults     Policy
+		plan         models.PsPlans
+		wantMaxSize  int64
+		wantMaxFiles int
+	}{
+		{"no overrides", Policy{MaxFileSize: 100, MaxFilesPerShare: 10}, models.PsPlans{}, 100, 10},
+		{"tighter", Policy{MaxFileSize: 100, MaxFilesPerShare: 10}, models.PsPlans{MaxFileSize: size(50), MaxFilesPerShare: count(5)}, 50, 5},
+		{"looser", Policy{MaxFileSize: 100, MaxFilesPerShare: 10}, models.PsPlans{MaxFileSize: size(500), MaxFilesPerShare: count(50)}, 100, 10},
+		{"zero keeps the default", Policy{MaxFileSize: 100, MaxFilesPerShare: 10}, models.PsPlans{MaxFileSize: size(0), MaxFilesPerShare: count(0)}, 100, 10},
+		{"limits unlimited defaults", Policy{}, models.PsPlans{MaxFileSize: size(50), MaxFilesPerShare: count(5)}, 50, 5},
+		{"zero with unlimited defaults", Policy{}, models.PsPlans{MaxFileSize: size(0), MaxFilesPerShare: count(0)}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.defaults.withPlan(&tt.plan)
+			if got.MaxFileSize != tt.wantMaxSize || got.MaxFilesPerShare != tt.wantMaxFiles {
+				t.Errorf("limits %d, %d, want %d, %d", got.MaxFileSize, got.MaxFilesPerShare, tt.wantMaxSize, tt.wantMaxFiles)
+			}
+		})
+	}
+}
@@ -7,6 +7,9 @@ import {
 	text,
 	boolean,
 	bigint,
+	jsonb,
+	date,
+	primaryKey,
 	index,
 	uniqueIndex,
 	check
@@ -20,12 +23,27 @@ export const ps_plans = pgTable(
 		id: integer('id').primaryKey(),
 		polar_id: varchar('polar_id', { length: 255 }),
 		plan_name: varchar('plan_name', { length: 100 }).notNull(),
-		quota: bigint('quota', { mode: 'number' }).notNull() // in MB
+		quota: bigint('quota', { mode: 'number' }).notNull(), // in MB
+		// upload policy overrides, null falls back to the pss-fs defaults
+		max_file_size: bigint('max_file_size', { mode: 'number' }), // in bytes
+		max_files_per_share: integer('max_files_per_share'),
+		allowed_mimetypes: text('allowed_mimetypes'), // comma-separated, e.g. 'image/*,application/pdf'
+		blocked_mimetypes: text('blocked_mimetypes'),
+		allowed_extensions: text('allowed_extensions'), // comma-separated, e.g. '.jpg,.png'
+		blocked_extensions: text('blocked_extensions')
 	},
 	(table) => [
 		index('ps_plans_polar_id_idx').on(table.polar_id),
 		index('ps_plans_plan_name_idx').on(table.plan_name),
-		check('quota_positive', sql`${table.quota} >= 0`)
+		check('quota_positive', sql`${table.quota} >= 0`),
+		check(
+			'max_file_size_positive',
+			sql`${table.max_file_size} IS NULL OR ${table.max_file_size} >= 0`
+		),
+		check(
+			'max_files_per_share_positive',
+			sql`${table.max_files_per_share} IS NULL OR ${table.max_files_per_share} >= 0`
+		)
 	]
 );
 
@@ -121,7 +139,17 @@ export const ps_files = pgTable(
 		file_name: varchar('file_name', { length: 255 }).notNull(),
 		mimetype: varchar('mimetype', { length: 100 }).notNull(),
 		hash: varchar('hash', { length: 255 }).notNull(),
-		size: bigint('size', { mode: 'number' }).notNull()
+		size: bigint('size', { mode: 'number' }).notNull(),
+		relative_path: varchar('relative_path', { length: 1024 }), // folder within the share, '/'-separated, null at the root
+		// end-to-end encrypted uploads, file_name/mimetype are placeholders and the real
+		// values are inside encrypted_metadata which only the client can decrypt
+		is_e2ee: boolean('is_e2ee').default(false).notNull(),
+		encrypted_metadata: text('encrypted_metadata'), // base64, opaque to the server
+		// encryption at rest (managed by pss-fs), null when the blob is stored in plaintext
+		encryption_key_id: varchar('encryption_key_id', { length: 64 }), // master key that wraps the data key
+		encrypted_data_key: varchar('encrypted_data_key', { length: 255 }),
+		encryption_nonce: varchar('encryption_nonce', { length: 64 }),
+		encryption_chunk_size: integer('encryption_chunk_size')
 	},
 	(table) => [
 		index('ps_files_share_id_idx').on(table.share_id),
@@ -218,8 +246,10 @@ export const ps_download_analytics = pgTable(
 		timestamp: timestamp('timestamp', { withTimezone: true }).defaultNow().notNull(),
 		ip_address: varchar('ip_address', { length: 45 }),
 		user_agent: varchar('user_agent', { length: 512 }),
-		country: varchar('country', { length: 2 }), // ISO country code (but how to get this?)
-		city: varchar('city', { length: 100 })
+		country: varchar('country', { length: 2 }), // ISO country code, from the GeoIP database
+		city: varchar('city', { length: 100 }),
+		bytes_sent: bigint('bytes_sent', { mode: 'number' }),
+		status: varchar('status', { length: 16 }) // 'completed' | 'partial' | 'incomplete' (not counted)
 	},
 	(table) => [
 		index('ps_download_analytics_share_id_idx').on(table.share_id),
@@ -242,15 +272,84 @@ export const ps_visit_analytics = pgTable(
 		user_agent: varchar('user_agent', { length: 512 }),
 		referrer: varchar('referrer', { length: 512 }),
 		country: varchar('country', { length: 2 }),
-		city: varchar('city', { length: 100 })
+		city: varchar('city', { length: 100 }),
+		visitor_hash: varchar('visitor_hash', { length: 64 }) // keyed hash used to deduplicate repeat visits
 	},
 	(table) => [
 		index('ps_visit_analytics_share_id_idx').on(table.share_id),
+		index('ps_visit_analytics_visitor_idx').on(table.share_id, table.visitor_hash, table.timestamp),
 		index('ps_visit_analytics_timestamp_idx').on(table.timestamp),
 		index('ps_visit_analytics_ip_address_idx').on(table.ip_address)
 	]
 );
 
+// ps_audit_log (created and written by pss-fs, append-only)
+// no foreign keys so entries outlive the users, shares and files they mention
+export const ps_audit_log = pgTable(
+	'ps_audit_log',
+	{
+		id: uuid('id').primaryKey().defaultRandom(),
+		timestamp: timestamp('timestamp', { withTimezone: true }).defaultNow().notNull(),
+		event: varchar('event', { length: 64 }).notNull(), // e.g. 'signature.issued', 'file.deleted'
+		outcome: varchar('outcome', { length: 16 }).notNull(), // 'success' | 'failure'
+		actor_user_id: uuid('actor_user_id'),
+		actor: varchar('actor', { length: 255 }), // non-user actors, e.g. 'cli:admin@host'
+		share_id: uuid('share_id'),
+		file_id: uuid('file_id'),
+		ip_address: varchar('ip_address', { length: 45 }),
+		user_agent: varchar('user_agent', { length: 512 }),
+		reason: varchar('reason', { length: 255 }),
+		details: jsonb('details')
+	},
+	(table) => [
+		index('idx_ps_audit_log_timestamp').on(table.timestamp),
+		index('idx_ps_audit_log_event').on(table.event),
+		index('idx_ps_audit_log_actor_user_id').on(table.actor_user_id),
+		index('idx_ps_audit_log_share_id').on(table.share_id)
+	]
+);
+
+// ps_analytics_hourly (created and rebuilt by pss-fs from the analytics tables)
+export const ps_analytics_hourly = pgTable(
+	'ps_analytics_hourly',
+	{
+		share_id: uuid('share_id').notNull(),
+		bucket: timestamp('bucket', { withTimezone: true }).notNull(), // start of the hour, in UTC
+		downloads: bigint('downloads', { mode: 'number' }).default(0).notNull(),
+		visits: bigint('visits', { mode: 'number' }).default(0).notNull(),
+		unique_visitors: bigint('unique_visitors', { mode: 'number' }).default(0).notNull()
+	},
+	(table) => [
+		primaryKey({ columns: [table.share_id, table.bucket] }),
+		index('idx_ps_analytics_hourly_bucket').on(table.bucket)
+	]
+);
+
+// ps_analytics_daily (created and rebuilt by pss-fs from the analytics tables)
+export const ps_analytics_daily = pgTable(
+	'ps_analytics_daily',
+	{
+		share_id: uuid('share_id').notNull(),
+		day: date('day').notNull(), // UTC day
+		dimension: varchar('dimension', { length: 16 }).notNull(), // 'total' | 'file' | 'referrer' | 'country'
+		value: varchar('value', { length: 512 }).notNull(), // file ID, referrer host or country code, '' for totals
+		downloads: bigint('downloads', { mode: 'number' }).default(0).notNull(),
+		visits: bigint('visits', { mode: 'number' }).default(0).notNull(),
+		unique_visitors: bigint('unique_visitors', { mode: 'number' }).default(0).notNull()
+	},
+	(table) => [
+		primaryKey({ columns: [table.share_id, table.day, table.dimension, table.value] }),
+		index('idx_ps_analytics_daily_day').on(table.day)
+	]
+);
+
+// ps_schema_version (created and written by pss-fs on startup)
+export const ps_schema_version = pgTable('ps_schema_version', {
+	component: varchar('component', { length: 64 }).primaryKey(),
+	version: integer('version').notNull(),
+	migrated_at: timestamp('migrated_at', { withTimezone: true }).defaultNow().notNull()
+});
+
 // Export all tables for easy import
 export const tables = {
 	ps_plans,
@@ -263,5 +362,9 @@ export const tables = {
 	ps_upload_signatures,
 	ps_download_signatures,
 	ps_download_analytics,
-	ps_visit_analytics
+	ps_visit_analytics,
+	ps_audit_log,
+	ps_analytics_hourly,
+	ps_analytics_daily,
+	ps_schema_version
 };
@@ -12,7 +12,10 @@ import (
 
 func main() {
 	// Load config
-	cfg := config.Load()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 
 	// Connect to database WITHOUT running migrations
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=%s TimeZone=%s",
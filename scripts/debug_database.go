@@ -10,7 +10,10 @@ import (
 
 func main() {
 	// Load config and initialize database
-	cfg := config.Load()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 
 	fmt.Println("=== Database Configuration ===")
 	fmt.Printf("Host: %s\n", cfg.Database.Host)
@@ -7,6 +7,7 @@ import (
 	"os"
 	"time"
 
+	"planarcomputer/pss-fs/audit"
 	"planarcomputer/pss-fs/config"
 	"planarcomputer/pss-fs/database"
 	"planarcomputer/pss-fs/models"
@@ -25,7 +26,10 @@ func main() {
 	}
 
 	// Load config and initialize database
-	cfg := config.Load()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 	if err := database.Initialize(cfg); err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
@@ -121,6 +125,11 @@ func createTestSignature() {
 		log.Fatal("Error creating signature:", result.Error)
 	}
 
+	audit.LogCLI("debug_signatures.create", map[string]interface{}{
+		"share_id":     share.ID,
+		"signature_id": uploadSig.ID,
+	})
+
 	fmt.Printf("Created test signature:\n")
 	fmt.Printf("Raw: %s\n", signature)
 	fmt.Printf("Base64: %s\n", base64.StdEncoding.EncodeToString([]byte(signature)))
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"planarcomputer/pss-fs/audit"
+	"planarcomputer/pss-fs/config"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/storage"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage:")
+		fmt.Println("  go run ./scripts/encryption-keys generate <key_id> - Generate a new master key entry")
+		fmt.Println("  go run ./scripts/encryption-keys rotate           - Re-wrap all data keys with the active master key")
+		return
+	}
+
+	switch os.Args[1] {
+	case "generate":
+		if len(os.Args) < 3 {
+			fmt.Println("Please provide an id for the new key")
+			return
+		}
+		entry, err := storage.GenerateMasterKey(os.Args[2])
+		if err != nil {
+			log.Fatal("Failed to generate key:", err)
+		}
+		fmt.Println("Add this entry to the start of ENCRYPTION_MASTER_KEYS or the key file to make it active:")
+		fmt.Println(entry)
+	case "rotate":
+		rotateKeys()
+	default:
+		fmt.Printf("Unknown command: %s\n", os.Args[1])
+	}
+}
+
+func rotateKeys() {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if err := database.Initialize(cfg); err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+
+	store, err := storage.New(cfg.Storage)
+	if err != nil {
+		log.Fatal("Failed to initialize storage:", err)
+	}
+	if store.Keys == nil {
+		log.Fatal("Encryption at rest is not enabled, set ENCRYPTION_AT_REST=true")
+	}
+
+	count, err := store.RewrapKeys()
+	audit.LogCLI("encryption_keys.rotate", map[string]interface{}{
+		"active_key_id": store.Keys.ActiveKeyID(),
+		"rewrapped":     count,
+		"succeeded":     err == nil,
+	})
+	if err != nil {
+		log.Fatalf("Re-wrapped %d data keys before failing: %v", count, err)
+	}
+	fmt.Printf("Re-wrapped %d data keys with master key '%s'\n", count, store.Keys.ActiveKeyID())
+}
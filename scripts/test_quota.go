@@ -14,7 +14,10 @@ import (
 
 func main() {
 	// Load config and initialize database
-	cfg := config.Load()
+	cfg, err := config.Load(nil)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
 	if err := database.Initialize(cfg); err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
@@ -90,7 +93,7 @@ func main() {
 	fmt.Println("\n=== Testing Quota Calculation ===")
 
 	// Calculate quota for this user
-	err := utils.UpdateUserQuota(testUser.ID)
+	err = utils.UpdateUserQuota(testUser.ID)
 	if err != nil {
 		log.Printf("Error updating quota: %v", err)
 	} else {
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// NewHTTP2Server serves app over HTTP/2, which fasthttp doesn't speak, so browsers can run many
+// parallel downloads over one connection. Requests go through the same routes and middleware,
+// bodies are limited to bodyLimit bytes and responses are streamed rather than buffered.
+func NewHTTP2Server(app *fiber.App, bodyLimit int) *http.Server {
+	return &http.Server{
+		Handler:           fiberHandler(app, int64(bodyLimit)),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// ServeHTTP2 serves HTTP/2 (and HTTP/1.1 for clients that don't negotiate it) on port until srv is shut down
+func ServeHTTP2(srv *http.Server, port string, certs *Certificates) error {
+	ln, err := Listen(port, certs, "h2", "http/1.1")
+	if err != nil {
+		return err
+	}
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// fiberHandler runs a net/http request through the Fiber app
+func fiberHandler(app *fiber.App, bodyLimit int64) http.HandlerFunc {
+	handler := app.Handler()
+	logger := slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, bodyLimit))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fiber.ErrRequestEntityTooLarge.Message, fiber.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, fiber.ErrBadRequest.Message, fiber.StatusBadRequest)
+			}
+			return
+		}
+
+		var ctx fasthttp.RequestCtx
+		ctx.Init2(newRequestConn(r), logger, false)
+
+		req := &ctx.Request
+		req.Header.SetMethod(r.Method)
+		req.SetRequestURI(r.RequestURI)
+		req.Header.SetHost(r.Host)
+		for key, values := range r.Header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+		req.SetBody(body)
+		req.Header.SetContentLength(len(body))
+
+		handler(&ctx)
+
+		ctx.Response.Header.VisitAll(func(key, value []byte) {
+			// Hop-by-hop headers are not allowed in HTTP/2, net/http frames the body itself
+			switch string(key) {
+			case fiber.HeaderConnection, fiber.HeaderTransferEncoding:
+				return
+			}
+			w.Header().Add(string(key), string(value))
+		})
+		w.WriteHeader(ctx.Response.StatusCode())
+		if err := ctx.Response.BodyWriteTo(w); err != nil {
+			slog.Debug("HTTP/2 response interrupted", "error", err)
+		}
+	}
+}
+
+// requestConn presents a net/http request's connection to fasthttp, which reads the client's
+// address and TLS state from it. Nothing is read from or written to it.
+type requestConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+	state  *tls.ConnectionState
+}
+
+func newRequestConn(r *http.Request) *requestConn {
+	conn := &requestConn{remote: &net.TCPAddr{}, local: &net.TCPAddr{}, state: r.TLS}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		conn.remote = addr
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = addr
+	}
+	return conn
+}
+
+func (c *requestConn) RemoteAddr() net.Addr { return c.remote }
+func (c *requestConn) LocalAddr() net.Addr  { return c.local }
+func (c *requestConn) Handshake() error     { return nil }
+
+func (c *requestConn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
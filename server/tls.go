@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"planarcomputer/pss-fs/config"
+)
+
+// tlsVersions maps TLS_MIN_VERSION to its crypto/tls constant
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Certificates serves the certificate and client CAs from their files, picking up changes
+// without a restart so renewed certificates (e.g. from certbot) are used by new connections
+type Certificates struct {
+	cfg     config.TLSConfig
+	mu      sync.Mutex // serialises reloads
+	current atomic.Pointer[certificateState]
+}
+
+type certificateState struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modified  map[string]time.Time
+}
+
+// LoadCertificates reads the certificate, key and client CAs configured in cfg
+func LoadCertificates(cfg config.TLSConfig) (*Certificates, error) {
+	certs := &Certificates{cfg: cfg}
+	if err := certs.Reload(); err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+// Reload reads the files again, the current certificates are kept if they are invalid
+func (c *Certificates) Reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state := &certificateState{modified: make(map[string]time.Time)}
+	for _, path := range c.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		state.modified[path] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %w", err)
+		}
+	}
+	state.cert = &cert
+
+	if c.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		state.clientCAs = x509.NewCertPool()
+		if !state.clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in TLS_CLIENT_CA_FILE")
+		}
+	}
+
+	c.current.Store(state)
+	slog.Info("Loaded TLS certificate", "subject", cert.Leaf.Subject.String(), "expires", cert.Leaf.NotAfter)
+	return nil
+}
+
+// Watch reloads the files whenever one of them changes, checking every ReloadInterval
+func (c *Certificates) Watch() {
+	if c.cfg.ReloadInterval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !c.changed() {
+			continue
+		}
+		if err := c.Reload(); err != nil {
+			slog.Error("Failed to reload TLS certificate, keeping the current one", "error", err)
+		}
+	}
+}
+
+// changed reports whether any of the files was modified since it was loaded
+func (c *Certificates) changed() bool {
+	modified := c.current.Load().modified
+	for _, path := range c.files() {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(modified[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Certificates) files() []string {
+	files := []string{c.cfg.CertFile, c.cfg.KeyFile}
+	if c.cfg.ClientCAFile != "" {
+		files = append(files, c.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// TLSConfig returns a configuration that uses the latest certificates for every handshake.
+// Client certificates are requested but optional, routes that need one check for it.
+func (c *Certificates) TLSConfig(nextProtos ...string) *tls.Config {
+	minVersion := tlsVersions[c.cfg.MinVersion]
+	return &tls.Config{
+		MinVersion: minVersion,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			state := c.current.Load()
+			cfg := &tls.Config{
+				MinVersion:   minVersion,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*state.cert},
+			}
+			if state.clientCAs != nil {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				cfg.ClientCAs = state.clientCAs
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// Listen listens on port, terminating TLS with certs unless they are nil
+func Listen(port string, certs *Certificates, nextProtos ...string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil || certs == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, certs.TLSConfig(nextProtos...)), nil
+}
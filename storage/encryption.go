@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Encrypted blobs are a sequence of independently sealed AES-256-GCM chunks, so any byte
+// range can be decrypted by reading only the chunks that cover it. Each chunk's nonce is the
+// file's random prefix followed by the chunk index, and the additional data marks the final
+// chunk so a truncated blob fails to decrypt instead of silently losing its tail.
+
+// DefaultChunkSize is the plaintext size of each encrypted chunk
+const DefaultChunkSize = 64 * 1024
+
+const (
+	noncePrefixSize = 8
+	tagSize         = 16
+)
+
+// chunkNonce returns the nonce for a chunk
+func chunkNonce(prefix []byte, index int64) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], uint32(index))
+	return nonce
+}
+
+// chunkAAD returns the additional authenticated data for a chunk
+func chunkAAD(index int64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, uint64(index))
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// encryptWriter encrypts everything written to it into chunks.
+// A full chunk is only sealed once more data arrives, so Close can mark the last one as final.
+type encryptWriter struct {
+	dst       io.Writer
+	aead      cipher.AEAD
+	prefix    []byte
+	chunkSize int
+	buf       []byte
+	index     int64
+}
+
+func newEncryptWriter(dst io.Writer, dataKey, prefix []byte, chunkSize int) (*encryptWriter, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		dst:       dst,
+		aead:      aead,
+		prefix:    prefix,
+		chunkSize: chunkSize,
+		buf:       make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == w.chunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):w.chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final chunk, it does not close the underlying writer
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *encryptWriter) seal(final bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.prefix, w.index), w.buf, chunkAAD(w.index, final))
+	if _, err := w.dst.Write(sealed); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	w.index++
+	return nil
+}
+
+// decryptReader provides seekable plaintext access to an encrypted blob
+type decryptReader struct {
+	file      *os.File
+	aead      cipher.AEAD
+	prefix    []byte
+	chunkSize int64
+	size      int64
+	offset    int64
+
+	chunk      []byte
+	chunkIndex int64
+	sealed     []byte
+}
+
+func newDecryptReader(file *os.File, dataKey, prefix []byte, chunkSize int, size int64) (*decryptReader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		file:       file,
+		aead:       aead,
+		prefix:     prefix,
+		chunkSize:  int64(chunkSize),
+		size:       size,
+		chunkIndex: -1,
+		sealed:     make([]byte, chunkSize+tagSize),
+	}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	index := r.offset / r.chunkSize
+	if index != r.chunkIndex {
+		if err := r.load(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.chunk[r.offset-index*r.chunkSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.file.Close()
+}
+
+// load reads and decrypts a single chunk
+func (r *decryptReader) load(index int64) error {
+	lastIndex := max(r.size-1, 0) / r.chunkSize
+	plainSize := min(r.chunkSize, r.size-index*r.chunkSize)
+
+	sealed := r.sealed[:plainSize+tagSize]
+	if _, err := r.file.ReadAt(sealed, index*(r.chunkSize+tagSize)); err != nil {
+		return fmt.Errorf("failed to read encrypted chunk %d: %w", index, err)
+	}
+
+	chunk, err := r.aead.Open(r.chunk[:0], chunkNonce(r.prefix, index), sealed, chunkAAD(index, index == lastIndex))
+	if err != nil {
+		r.chunkIndex = -1
+		return fmt.Errorf("failed to decrypt chunk %d: %w", index, err)
+	}
+
+	r.chunk = chunk
+	r.chunkIndex = index
+	return nil
+}
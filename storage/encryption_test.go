@@ -0,0 +1,334 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"planarcomputer/pss-fs/models"
+
+	"github.com/google/uuid"
+)
+
+// testStore returns a store in a temporary directory encrypting with the given "id:base64key" entries
+func testStore(t *testing.T, entries ...string) *Store {
+	t.Helper()
+	keys, err := LoadKeyring(entries, "")
+	if err != nil {
+		t.Fatalf("LoadKeyring: %v", err)
+	}
+	return &Store{Dir: t.TempDir(), Keys: keys}
+}
+
+func testKey(t *testing.T, id string) string {
+	t.Helper()
+	entry, err := GenerateMasterKey(id)
+	if err != nil {
+		t.Fatalf("GenerateMasterKey: %v", err)
+	}
+	return entry
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// saveEncrypted saves data as a new file, returning its metadata
+func saveEncrypted(t *testing.T, store *Store, data []byte) *models.PsFiles {
+	t.Helper()
+	file := &models.PsFiles{ID: uuid.New()}
+	if err := store.Save(context.Background(), file, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if !file.IsEncrypted() {
+		t.Fatal("saved file has no encryption metadata")
+	}
+	return file
+}
+
+// readAll opens file and reads it to the end
+func readAll(store *Store, file *models.PsFiles) ([]byte, error) {
+	blob, err := store.Open(context.Background(), file)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return io.ReadAll(blob)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	store := testStore(t, testKey(t, "k1"))
+
+	for _, size := range []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, DefaultChunkSize + 1, 3*DefaultChunkSize + 17} {
+		data := randomBytes(t, size)
+		file := saveEncrypted(t, store, data)
+		if file.Size != int64(size) {
+			t.Errorf("size %d: saved size %d", size, file.Size)
+		}
+
+		stored, err := os.ReadFile(store.Path(file.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size > 0 && bytes.Contains(stored, data[:min(size, 64)]) {
+			t.Errorf("size %d: blob contains plaintext", size)
+		}
+
+		got, err := readAll(store, file)
+		if err != nil {
+			t.Fatalf("size %d: read: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("size %d: read back %d different bytes", size, len(got))
+		}
+	}
+}
+
+func TestEncryptionRangeReads(t *testing.T) {
+	store := testStore(t, testKey(t, "k1"))
+	data := randomBytes(t, 3*DefaultChunkSize+100)
+	file := saveEncrypted(t, store, data)
+
+	tests := []struct {
+		name   string
+		offset int64
+		length int
+	}{
+		{"start", 0, 10},
+		{"within a chunk", 1000, 500},
+		{"last byte of a chunk", DefaultChunkSize - 1, 1},
+		{"across a boundary", DefaultChunkSize - 10, 20},
+		{"across several chunks", DefaultChunkSize / 2, 2 * DefaultChunkSize},
+		{"final chunk", 3 * DefaultChunkSize, 100},
+		{"tail", int64(len(data)) - 5, 5},
+	}
+	blob, err := store.Open(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	// Reads run out of order so chunks are reloaded rather than read sequentially
+	for i := len(tests) - 1; i >= 0; i-- {
+		tt := tests[i]
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := blob.Seek(tt.offset, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, tt.length)
+			if _, err := io.ReadFull(blob, got); err != nil {
+				t.Fatalf("ReadFull: %v", err)
+			}
+			if want := data[tt.offset : tt.offset+int64(tt.length)]; !bytes.Equal(got, want) {
+				t.Error("read different bytes")
+			}
+		})
+	}
+}
+
+func TestEncryptionSeek(t *testing.T) {
+	store := testStore(t, testKey(t, "k1"))
+	data := randomBytes(t, 2*DefaultChunkSize)
+	file := saveEncrypted(t, store, data)
+
+	blob, err := store.Open(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	if pos, err := blob.Seek(-10, io.SeekEnd); err != nil || pos != int64(len(data))-10 {
+		t.Fatalf("Seek from end = %d, %v", pos, err)
+	}
+	tail, _ := io.ReadAll(blob)
+	if !bytes.Equal(tail, data[len(data)-10:]) {
+		t.Error("read different bytes after seeking from the end")
+	}
+
+	if _, err := blob.Seek(DefaultChunkSize-5, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err := blob.Seek(10, io.SeekCurrent); err != nil || pos != DefaultChunkSize+5 {
+		t.Fatalf("Seek from current = %d, %v", pos, err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(blob, got); err != nil || !bytes.Equal(got, data[DefaultChunkSize+5:DefaultChunkSize+10]) {
+		t.Errorf("read after seeking from current: %v", err)
+	}
+
+	if _, err := blob.Seek(-1, io.SeekStart); err == nil {
+		t.Error("seeking before the start succeeded")
+	}
+	if _, err := blob.Seek(int64(len(data))+10, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := blob.Read(got); n != 0 || err != io.EOF {
+		t.Errorf("read past the end = %d, %v, want io.EOF", n, err)
+	}
+}
+
+func TestEncryptionDetectsDamage(t *testing.T) {
+	const chunks = 3
+	sealedChunk := int64(DefaultChunkSize + tagSize)
+
+	tests := []struct {
+		name   string
+		damage func(t *testing.T, path string, file *models.PsFiles)
+	}{
+		{"flipped byte", func(t *testing.T, path string, file *models.PsFiles) {
+			stored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored[sealedChunk+10] ^= 1
+			if err := os.WriteFile(path, stored, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"truncated mid-chunk", func(t *testing.T, path string, file *models.PsFiles) {
+			if err := os.Truncate(path, chunks*sealedChunk-10); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"final chunk dropped", func(t *testing.T, path string, file *models.PsFiles) {
+			// Even with a matching size, the new last chunk was never sealed as final
+			if err := os.Truncate(path, (chunks-1)*sealedChunk); err != nil {
+				t.Fatal(err)
+			}
+			file.Size = (chunks - 1) * DefaultChunkSize
+		}},
+		{"chunks swapped", func(t *testing.T, path string, file *models.PsFiles) {
+			stored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first := bytes.Clone(stored[:sealedChunk])
+			copy(stored[:sealedChunk], stored[sealedChunk:2*sealedChunk])
+			copy(stored[sealedChunk:2*sealedChunk], first)
+			if err := os.WriteFile(path, stored, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"wrong nonce", func(t *testing.T, path string, file *models.PsFiles) {
+			nonce := "AAAAAAAAAAA="
+			file.EncryptionNonce = &nonce
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := testStore(t, testKey(t, "k1"))
+			file := saveEncrypted(t, store, randomBytes(t, chunks*DefaultChunkSize))
+			tt.damage(t, store.Path(file.ID), file)
+
+			if _, err := readAll(store, file); err == nil {
+				t.Error("damaged blob read without error")
+			}
+		})
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	k1, k2 := testKey(t, "k1"), testKey(t, "k2")
+	old := testStore(t, k1)
+	data := randomBytes(t, DefaultChunkSize+1)
+	file := saveEncrypted(t, old, data)
+	if *file.EncryptionKeyId != "k1" {
+		t.Fatalf("wrapped with %s, want k1", *file.EncryptionKeyId)
+	}
+
+	// A keyring with a new active key still reads files wrapped with the old one
+	rotated := &Store{Dir: old.Dir, Keys: testStore(t, k2, k1).Keys}
+	if rotated.Keys.ActiveKeyID() != "k2" {
+		t.Fatalf("active key %s, want k2", rotated.Keys.ActiveKeyID())
+	}
+	if got, err := readAll(rotated, file); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read with rotated keyring: %v", err)
+	}
+
+	// Re-wrapping as RewrapKeys does moves the file to the new key without touching the blob
+	dataKey, err := rotated.Keys.Unwrap(*file.EncryptionKeyId, *file.EncryptedDataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, wrapped, err := rotated.Keys.Wrap(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.EncryptionKeyId, file.EncryptedDataKey = &keyID, &wrapped
+
+	newOnly := &Store{Dir: old.Dir, Keys: testStore(t, k2).Keys}
+	if got, err := readAll(newOnly, file); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read re-wrapped file without the old key: %v", err)
+	}
+	if _, err := readAll(old, file); err == nil {
+		t.Error("old keyring read a file wrapped with a key it doesn't have")
+	}
+
+	// A different key under the same id can't unwrap the data key
+	impostor := &Store{Dir: old.Dir, Keys: testStore(t, testKey(t, "k2")).Keys}
+	if _, err := readAll(impostor, file); err == nil {
+		t.Error("read with a different key of the same id")
+	}
+
+	// The wrapped key is bound to its key id
+	other := "k1"
+	file.EncryptionKeyId = &other
+	if _, err := readAll(rotated, file); err == nil {
+		t.Error("unwrapped a data key under the wrong key id")
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	k1, k2 := testKey(t, "k1"), testKey(t, "k2")
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(keyFile, []byte("# rotated in March\n"+k2+"\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		entries    []string
+		keyFile    string
+		wantActive string
+		wantErr    string
+	}{
+		{"single", []string{k1}, "", "k1", ""},
+		{"first is active", []string{k2, k1}, "", "k2", ""},
+		{"key file after entries", []string{k1}, keyFile, "k1", ""},
+		{"key file only", nil, keyFile, "k2", ""},
+		{"none", nil, "", "", "no master keys"},
+		{"missing file", nil, filepath.Join(t.TempDir(), "missing"), "", "failed to read key file"},
+		{"no id", []string{strings.TrimPrefix(k1, "k1")}, "", "", "id:base64key"},
+		{"no separator", []string{"k1"}, "", "", "id:base64key"},
+		{"duplicate id", []string{k1, "k1:" + strings.SplitN(k2, ":", 2)[1]}, "", "", "duplicate"},
+		{"short key", []string{"k1:c2hvcnQ="}, "", "", "32 base64-encoded bytes"},
+		{"not base64", []string{"k1:!!!"}, "", "", "32 base64-encoded bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadKeyring(tt.entries, tt.keyFile)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadKeyring error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadKeyring: %v", err)
+			}
+			if keys.ActiveKeyID() != tt.wantActive {
+				t.Errorf("active key %s, want %s", keys.ActiveKeyID(), tt.wantActive)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// masterKeySize is the size of AES-256 master and data keys
+const masterKeySize = 32
+
+// Keyring holds the master keys used to wrap per-file data keys.
+// The active key wraps new data keys, older keys are kept so existing files can still be read.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+// LoadKeyring builds a keyring from "id:base64key" entries and an optional key file holding
+// one entry per line. The first entry is the active key, so rotating means prepending a new one.
+func LoadKeyring(entries []string, keyFile string) (*Keyring, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, errors.New("encryption at rest is enabled but no master keys are configured")
+	}
+
+	keyring := &Keyring{keys: make(map[string]cipher.AEAD, len(entries))}
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, errors.New("master keys must be in the form id:base64key")
+		}
+		if _, exists := keyring.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate master key id '%s'", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != masterKeySize {
+			return nil, fmt.Errorf("master key '%s' must be %d base64-encoded bytes", id, masterKeySize)
+		}
+
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+		if keyring.active == "" {
+			keyring.active = id
+		}
+	}
+
+	return keyring, nil
+}
+
+// GenerateMasterKey returns a new random master key entry for the given id
+func GenerateMasterKey(id string) (string, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ActiveKeyID returns the id of the key used to wrap new data keys
+func (k *Keyring) ActiveKeyID() string {
+	return k.active
+}
+
+// Wrap encrypts a data key with the active master key
+func (k *Keyring) Wrap(dataKey []byte) (keyID string, wrapped string, err error) {
+	aead := k.keys[k.active]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, dataKey, []byte(k.active))
+	return k.active, base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Unwrap decrypts a data key that was wrapped with the given master key
+func (k *Keyring) Unwrap(keyID, wrapped string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key '%s'", keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed wrapped data key")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with master key '%s': %w", keyID, err)
+	}
+	return dataKey, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package storage
+
+import "errors"
+
+// FreeSpace is not supported on this platform
+func (s *Store) FreeSpace() (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"planarcomputer/pss-fs/config"
+	"planarcomputer/pss-fs/database"
+	"planarcomputer/pss-fs/models"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Store keeps file blobs in a local directory, named by file ID
+type Store struct {
+	Dir  string
+	Keys *Keyring // nil when encryption at rest is disabled
+
+	mu     sync.Mutex
+	saving map[string]bool // temporary files of saves in progress
+}
+
+// File is a readable, seekable blob
+type File interface {
+	io.ReadSeekCloser
+}
+
+// New creates the files directory and loads the master keys if encryption at rest is enabled
+func New(cfg config.StorageConfig) (*Store, error) {
+	if err := os.MkdirAll(cfg.FilesDirectory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create files directory: %w", err)
+	}
+
+	store := &Store{Dir: cfg.FilesDirectory}
+	if cfg.EncryptionEnabled {
+		keys, err := LoadKeyring(cfg.MasterKeys, cfg.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		store.Keys = keys
+		slog.Info("Encryption at rest enabled", "active_key_id", keys.ActiveKeyID())
+	}
+
+	return store, nil
+}
+
+// Path returns the on-disk location of a file's blob
+func (s *Store) Path(fileID uuid.UUID) string {
+	return filepath.Join(s.Dir, fileID.String())
+}
+
+// Save writes src as the blob for file, encrypting it when enabled. The file's size, hash
+// and encryption metadata are filled in from the plaintext. The blob only appears under its
+// final name once it has been completely written, and is removed if ctx is cancelled first.
+func (s *Store) Save(ctx context.Context, file *models.PsFiles, src io.Reader) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.save", trace.WithAttributes(
+		attribute.String("pssfs.file_id", file.ID.String()),
+		attribute.Bool("pssfs.encrypted", s.Keys != nil),
+	))
+	defer func() { endSpan(span, err) }()
+
+	tmp, err := os.CreateTemp(s.Dir, uploadTempPrefix+file.ID.String()+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob: %w", err)
+	}
+	s.track(tmp.Name())
+	defer s.untrack(tmp.Name())
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var dst io.Writer = tmp
+	var encrypter *encryptWriter
+	if s.Keys != nil {
+		encrypter, err = s.newEncrypter(file, tmp)
+		if err != nil {
+			return err
+		}
+		dst = encrypter
+	}
+
+	hash := sha256.New()
+	hasher, blob := &timedWriter{w: hash}, &timedWriter{w: dst}
+	copyStarted := time.Now()
+	size, err := io.Copy(io.MultiWriter(blob, hasher), contextReader{ctx, src})
+	hasher.span(ctx, "storage.hash", copyStarted)
+	blob.span(ctx, "storage.write", copyStarted)
+	if err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if encrypter != nil {
+		if err := encrypter.Close(); err != nil {
+			return fmt.Errorf("failed to write blob: %w", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.Path(file.ID)); err != nil {
+		return fmt.Errorf("failed to store blob: %w", err)
+	}
+
+	file.Size = size
+	file.Hash = hex.EncodeToString(hash.Sum(nil))
+	span.SetAttributes(attribute.Int64("pssfs.size", size))
+	return nil
+}
+
+// Remove deletes a file's blob, a blob that doesn't exist is not an error
+func (s *Store) Remove(fileID uuid.UUID) error {
+	if err := os.Remove(s.Path(fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Open returns the plaintext contents of a file's blob, decrypting transparently
+func (s *Store) Open(ctx context.Context, file *models.PsFiles) (File, error) {
+	_, span := tracer.Start(ctx, "storage.read", trace.WithAttributes(
+		attribute.String("pssfs.file_id", file.ID.String()),
+		attribute.Bool("pssfs.encrypted", file.IsEncrypted()),
+	))
+
+	f, err := os.Open(s.Path(file.ID))
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+	if !file.IsEncrypted() {
+		return &tracedFile{File: f, span: span}, nil
+	}
+
+	reader, err := s.newDecrypter(file, f)
+	if err != nil {
+		f.Close()
+		endSpan(span, err)
+		return nil, err
+	}
+	return &tracedFile{File: reader, span: span}, nil
+}
+
+// Probe checks that the files directory can be written to and read back
+func (s *Store) Probe() error {
+	want := make([]byte, 32)
+	if _, err := rand.Read(want); err != nil {
+		return err
+	}
+
+	probe, err := os.CreateTemp(s.Dir, probeTempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("failed to create probe file: %w", err)
+	}
+	defer os.Remove(probe.Name())
+
+	_, err = probe.Write(want)
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write probe file: %w", err)
+	}
+
+	got, err := os.ReadFile(probe.Name())
+	if err != nil {
+		return fmt.Errorf("failed to read probe file: %w", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("probe file read back differently than written")
+	}
+	return nil
+}
+
+// newEncrypter generates and wraps a data key for file and returns a writer that encrypts with it
+func (s *Store) newEncrypter(file *models.PsFiles, dst io.Writer) (*encryptWriter, error) {
+	dataKey := make([]byte, masterKeySize)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := s.Keys.Wrap(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	nonce := base64.StdEncoding.EncodeToString(prefix)
+	chunkSize := DefaultChunkSize
+	file.EncryptionKeyId = &keyID
+	file.EncryptedDataKey = &wrapped
+	file.EncryptionNonce = &nonce
+	file.EncryptionChunkSize = &chunkSize
+
+	return newEncryptWriter(dst, dataKey, prefix, chunkSize)
+}
+
+// newDecrypter unwraps the file's data key and returns a seekable plaintext reader
+func (s *Store) newDecrypter(file *models.PsFiles, f *os.File) (*decryptReader, error) {
+	if s.Keys == nil {
+		return nil, fmt.Errorf("file %s is encrypted but encryption at rest is not configured", file.ID)
+	}
+	if file.EncryptionKeyId == nil || file.EncryptionNonce == nil || file.EncryptionChunkSize == nil {
+		return nil, fmt.Errorf("file %s has incomplete encryption metadata", file.ID)
+	}
+
+	dataKey, err := s.Keys.Unwrap(*file.EncryptionKeyId, *file.EncryptedDataKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := base64.StdEncoding.DecodeString(*file.EncryptionNonce)
+	if err != nil || len(prefix) != noncePrefixSize {
+		return nil, fmt.Errorf("file %s has a malformed encryption nonce", file.ID)
+	}
+
+	return newDecryptReader(f, dataKey, prefix, *file.EncryptionChunkSize, file.Size)
+}
+
+// RewrapKeys re-wraps every data key that is not wrapped with the active master key.
+// Blobs themselves are never rewritten, so a rotation only touches the database.
+func (s *Store) RewrapKeys() (int, error) {
+	if s.Keys == nil {
+		return 0, fmt.Errorf("encryption at rest is not configured")
+	}
+
+	var files []models.PsFiles
+	result := database.DB.Where("encrypted_data_key IS NOT NULL AND encryption_key_id <> ?", s.Keys.ActiveKeyID()).Find(&files)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	for i, file := range files {
+		dataKey, err := s.Keys.Unwrap(*file.EncryptionKeyId, *file.EncryptedDataKey)
+		if err != nil {
+			return i, err
+		}
+		keyID, wrapped, err := s.Keys.Wrap(dataKey)
+		if err != nil {
+			return i, err
+		}
+
+		result := database.DB.Model(&models.PsFiles{}).Where("id = ?", file.ID).Updates(map[string]interface{}{
+			"encryption_key_id":  keyID,
+			"encrypted_data_key": wrapped,
+		})
+		if result.Error != nil {
+			return i, result.Error
+		}
+	}
+
+	return len(files), nil
+}
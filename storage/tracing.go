@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("planarcomputer/pss-fs/storage")
+
+// endSpan ends a span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// timedWriter accumulates the time spent writing to w. Hashing and writing a blob happen in
+// the same copy, so their spans show the total time each took from the start of the copy.
+type timedWriter struct {
+	w       io.Writer
+	elapsed time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	t.elapsed += time.Since(start)
+	return n, err
+}
+
+// span records a span that took elapsed, starting at start
+func (t *timedWriter) span(ctx context.Context, name string, start time.Time) {
+	_, span := tracer.Start(ctx, name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(start.Add(t.elapsed)))
+}
+
+// tracedFile ends the read span of a blob when it is closed, which for downloads is once the
+// response has been sent
+type tracedFile struct {
+	File
+	span trace.Span
+	read int64
+}
+
+func (f *tracedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	f.read += int64(n)
+	return n, err
+}
+
+func (f *tracedFile) Close() error {
+	err := f.File.Close()
+	f.span.SetAttributes(attribute.Int64("pssfs.bytes_read", f.read))
+	endSpan(f.span, err)
+	return err
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Temporary files are written next to the blobs and renamed into place once complete
+const (
+	uploadTempPrefix = ".upload-"
+	probeTempPrefix  = ".health-"
+)
+
+// staleTempAge is how long a temporary file must go unmodified before it is considered left
+// behind by a process that didn't shut down cleanly. Files of saves in progress keep being written.
+const staleTempAge = time.Hour
+
+// drainPollInterval is how often Drain checks whether the saves in progress have finished
+const drainPollInterval = 100 * time.Millisecond
+
+// track records the temporary file of a save in progress
+func (s *Store) track(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.saving == nil {
+		s.saving = make(map[string]bool)
+	}
+	s.saving[path] = true
+}
+
+// untrack records that a save finished and its temporary file is gone
+func (s *Store) untrack(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.saving, path)
+}
+
+// Drain waits for the saves in progress to finish. Saves are aborted by cancelling their context,
+// after which they remove their own temporary files. Any still left when ctx is done are removed.
+func (s *Store) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		remaining := len(s.saving)
+		s.mu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for path := range s.saving {
+				os.Remove(path)
+			}
+			return fmt.Errorf("removed %d incomplete uploads: %w", remaining, ctx.Err())
+		}
+	}
+}
+
+// RemoveStaleTemp removes temporary files left behind in the files directory by a previous run
+func (s *Store) RemoveStaleTemp() (int, error) {
+	var removed int
+	for _, prefix := range []string{uploadTempPrefix, probeTempPrefix} {
+		paths, err := filepath.Glob(filepath.Join(s.Dir, prefix+"*"))
+		if err != nil {
+			return removed, err
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || time.Since(info.ModTime()) < staleTempAge {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// contextReader stops reading once its context is cancelled, aborting the copy it feeds
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
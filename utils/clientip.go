@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// trustedProxies are the networks whose X-Forwarded-For and X-Real-IP headers are believed, they
+// can be replaced while serving
+var trustedProxies atomic.Pointer[[]*net.IPNet]
+
+// SetTrustedProxies configures the proxies (CIDRs or single IPs) allowed to report client addresses
+func SetTrustedProxies(proxies []string) error {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy '%s': %w", proxy, err)
+		}
+		networks = append(networks, network)
+	}
+
+	trustedProxies.Store(&networks)
+	return nil
+}
+
+// ClientIP returns the address of the client that made the request. Proxy headers are only
+// honoured when the connection comes from a trusted proxy. X-Forwarded-For is walked from the
+// right so a client can't spoof its address by sending its own header, and X-Real-IP is used
+// when it names no untrusted hop.
+func ClientIP(c *fiber.Ctx) string {
+	remote := c.Context().RemoteIP()
+	if !isTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	hops := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(c.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return remote.String()
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	networks := trustedProxies.Load()
+	if networks == nil {
+		return false
+	}
+	for _, network := range *networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
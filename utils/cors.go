@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// corsOrigins are the browser origins allowed to call the API
+type corsOrigins struct {
+	exact map[string]bool
+	// wildcards are origins such as https://*.planarshare.com, split around the "*"
+	wildcards []wildcardOrigin
+}
+
+type wildcardOrigin struct {
+	prefix string // scheme://
+	suffix string // .domain[:port]
+}
+
+// allowedOrigins can be replaced while serving
+var allowedOrigins atomic.Pointer[corsOrigins]
+
+// SetAllowedOrigins configures the origins (scheme://host[:port]) allowed by CORS. A leading "*."
+// in the host allows every subdomain, at any depth, but not the domain itself.
+func SetAllowedOrigins(origins []string) error {
+	allowed := corsOrigins{exact: make(map[string]bool, len(origins))}
+	for _, origin := range origins {
+		normalized, err := normalizeOrigin(origin)
+		if err != nil {
+			return err
+		}
+
+		scheme, host, _ := strings.Cut(normalized, "://")
+		if !strings.Contains(host, "*") {
+			allowed.exact[normalized] = true
+			continue
+		}
+		if !strings.HasPrefix(host, "*.") || strings.Count(host, "*") > 1 || !strings.Contains(host[2:], ".") {
+			return fmt.Errorf("invalid origin '%s', wildcards must be a leading *. before a domain such as *.example.com", origin)
+		}
+		allowed.wildcards = append(allowed.wildcards, wildcardOrigin{prefix: scheme + "://", suffix: host[1:]})
+	}
+
+	allowedOrigins.Store(&allowed)
+	return nil
+}
+
+// AllowOrigin reports whether a browser origin may call the API
+func AllowOrigin(origin string) bool {
+	allowed := allowedOrigins.Load()
+	if allowed == nil {
+		return false
+	}
+	normalized, err := normalizeOrigin(origin)
+	if err != nil || strings.Contains(normalized, "*") {
+		return false
+	}
+	if allowed.exact[normalized] {
+		return true
+	}
+
+	for _, w := range allowed.wildcards {
+		if strings.HasPrefix(normalized, w.prefix) && strings.HasSuffix(normalized, w.suffix) &&
+			len(normalized) > len(w.prefix)+len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeOrigin lowercases an origin, rejecting anything with more than a scheme, host and port
+func normalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid origin '%s', expected scheme://host[:port]", origin)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
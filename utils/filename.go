@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxFileNameLength matches the size of the ps_files.file_name column
+const MaxFileNameLength = 255
+
+// MaxRelativePathLength matches the size of the ps_files.relative_path column
+const MaxRelativePathLength = 1024
+
+// SanitizeFileName normalises a client supplied filename so it is safe to store,
+// use in Content-Disposition headers and use as an archive entry name
+func SanitizeFileName(name string) string {
+	// Normalise to NFC so visually identical names compare equal
+	name = norm.NFC.String(strings.ToValidUTF8(name, ""))
+
+	// Drop any directory components, regardless of the client's platform
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = cleanPathSegment(name)
+	if name == "" {
+		return "file"
+	}
+
+	return truncateFileName(name, MaxFileNameLength)
+}
+
+// SanitizeRelativePath normalises the folder a client places a file in, a relative path with / or \
+// separators. It returns "" for the share's root, and an error for absolute paths and paths that
+// climb out of the share.
+func SanitizeRelativePath(path string) (string, error) {
+	path = norm.NFC.String(strings.ToValidUTF8(path, ""))
+	path = strings.ReplaceAll(path, `\`, "/")
+	if strings.HasPrefix(path, "/") || (len(path) >= 2 && path[1] == ':') {
+		return "", errors.New("path must be relative")
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return "", errors.New("path must not contain ..")
+		}
+		// Empty and "." segments, and ones left empty once cleaned, name no folder
+		if segment = cleanPathSegment(segment); segment != "" {
+			segments = append(segments, truncateFileName(segment, MaxFileNameLength))
+		}
+	}
+
+	path = strings.Join(segments, "/")
+	if utf8.RuneCountInString(path) > MaxRelativePathLength {
+		return "", fmt.Errorf("path must be at most %d characters", MaxRelativePathLength)
+	}
+	return path, nil
+}
+
+// cleanPathSegment strips what isn't safe in a file or folder name, possibly leaving nothing
+func cleanPathSegment(name string) string {
+	// Strip control and other invisible formatting characters
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	// Trailing dots and spaces are silently dropped by Windows, leading dots hide files
+	return strings.Trim(name, " .")
+}
+
+// truncateFileName shortens name to at most max characters, keeping the extension where possible
+func truncateFileName(name string, max int) string {
+	if utf8.RuneCountInString(name) <= max {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if utf8.RuneCountInString(ext) >= max/2 {
+		ext = ""
+	}
+	base := []rune(strings.TrimSuffix(name, ext))
+	return string(base[:max-utf8.RuneCountInString(ext)]) + ext
+}
+
+// UniqueFileName returns name, or name with a " (n)" suffix if it has already been used.
+// Names are compared case-insensitively so archives extract cleanly on every platform.
+func UniqueFileName(seen map[string]bool, name string) string {
+	candidate := name
+	ext := filepath.Ext(name)
+	if utf8.RuneCountInString(ext) >= MaxFileNameLength/2 {
+		ext = ""
+	}
+	base := []rune(strings.TrimSuffix(name, ext))
+
+	for n := 1; seen[strings.ToLower(candidate)]; n++ {
+		// The base gives way to the suffix, which must survive for the candidate to differ
+		suffix := fmt.Sprintf(" (%d)", n)
+		keep := min(len(base), MaxFileNameLength-utf8.RuneCountInString(suffix)-utf8.RuneCountInString(ext))
+		candidate = string(base[:keep]) + suffix + ext
+	}
+
+	seen[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// ContentDisposition builds an RFC 6266 Content-Disposition header value with an
+// ASCII fallback filename and a UTF-8 encoded filename* parameter
+func ContentDisposition(disposition, filename string) string {
+	filename = SanitizeFileName(filename)
+
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || r == '"' || r == '\\' || r == '%' {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback, encodeExtValue(filename))
+}
+
+// encodeExtValue percent-encodes s as an RFC 5987 ext-value, leaving only attr-chars as-is
+func encodeExtValue(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if isAttrChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
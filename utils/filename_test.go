@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"unix path", "../../etc/passwd", "passwd"},
+		{"windows path", `C:\Users\me\report.pdf`, "report.pdf"},
+		{"control characters", "re\x00po\nrt.pdf", "report.pdf"},
+		{"bidi override", "invoice\u202Efdp.exe", "invoicefdp.exe"},
+		{"leading and trailing dots", "..hidden.txt. ", "hidden.txt"},
+		{"nothing left", " ../.. ", "file"},
+		{"empty", "", "file"},
+		{"invalid utf-8", "a\xffb.txt", "ab.txt"},
+		{"nfc", "e\u0301.txt", "\u00e9.txt"},
+		{"too long", strings.Repeat("a", 300) + ".txt", strings.Repeat("a", 251) + ".txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SanitizeFileName(tt.in); got != tt.want {
+				t.Errorf("SanitizeFileName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		max  int
+		want string
+	}{
+		{"short enough", "a.txt", 10, "a.txt"},
+		{"keeps extension", "abcdefgh.txt", 10, "abcdef.txt"},
+		{"counts runes", "éééééééé.txt", 10, "éééééé.txt"},
+		{"drops long extension", "a." + strings.Repeat("x", 10), 8, "a.xxxxxx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateFileName(tt.in, tt.max); got != tt.want {
+				t.Errorf("truncateFileName(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueFileName(t *testing.T) {
+	long := strings.Repeat("a", 251) + ".txt"
+	longExt := "a." + strings.Repeat("x", 200)
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		{"distinct", []string{"a.txt", "b.txt"}, []string{"a.txt", "b.txt"}},
+		{"duplicates", []string{"a.txt", "a.txt", "a.txt"}, []string{"a.txt", "a (1).txt", "a (2).txt"}},
+		{"case-insensitive", []string{"A.txt", "a.TXT"}, []string{"A.txt", "a (1).TXT"}},
+		{"suffix already taken", []string{"a (1).txt", "a.txt", "a.txt"}, []string{"a (1).txt", "a.txt", "a (2).txt"}},
+		{"no extension", []string{"README", "README"}, []string{"README", "README (1)"}},
+		{"longest name", []string{long, long, long}, []string{
+			long,
+			strings.Repeat("a", 247) + " (1).txt",
+			strings.Repeat("a", 247) + " (2).txt",
+		}},
+		{"long extension", []string{longExt, longExt}, []string{longExt, longExt + " (1)"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			for i, name := range tt.names {
+				got := UniqueFileName(seen, name)
+				if got != tt.want[i] {
+					t.Errorf("name %d: UniqueFileName(%q) = %q, want %q", i, name, got, tt.want[i])
+				}
+				if n := utf8.RuneCountInString(got); n > MaxFileNameLength {
+					t.Errorf("name %d: %d characters, want at most %d", i, n, MaxFileNameLength)
+				}
+			}
+		})
+	}
+}
+
+func TestUniqueFileNameMaxLength(t *testing.T) {
+	// Every name of the maximum length must still get a distinct candidate
+	for _, name := range []string{
+		strings.Repeat("a", MaxFileNameLength),
+		strings.Repeat("é", MaxFileNameLength-4) + ".txt",
+		"a." + strings.Repeat("x", MaxFileNameLength-2),
+	} {
+		seen := make(map[string]bool)
+		for i := 0; i < 20; i++ {
+			UniqueFileName(seen, name)
+		}
+		if len(seen) != 20 {
+			t.Errorf("%d distinct names for %q, want 20", len(seen), name[:10])
+		}
+	}
+}
+
+func TestSanitizeRelativePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"root", "", "", false},
+		{"nested", "photos/2024", "photos/2024", false},
+		{"backslashes", `photos\2024\`, "photos/2024", false},
+		{"dot segments", "./photos/./2024", "photos/2024", false},
+		{"empty segments", "photos//2024", "photos/2024", false},
+		{"cleaned segments", "photos/ . /\u202E2024 ", "photos/2024", false},
+		{"parent", "../photos", "", true},
+		{"parent inside", "photos/../../etc", "", true},
+		{"windows parent", `photos\..\..`, "", true},
+		{"absolute", "/etc/passwd", "", true},
+		{"drive letter", "C:/Windows", "", true},
+		{"too long", strings.Repeat("abcdefgh/", 120), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SanitizeRelativePath(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SanitizeRelativePath(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SanitizeRelativePath(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"report.pdf", `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`},
+		{`a"b.txt`, `attachment; filename="a_b.txt"; filename*=UTF-8''a%22b.txt`},
+		{"résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+	}
+	for _, tt := range tests {
+		if got := ContentDisposition("attachment", tt.in); got != tt.want {
+			t.Errorf("ContentDisposition(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLength is the number of leading bytes http.DetectContentType considers
+const sniffLength = 512
+
+// tarMagicOffset is where ustar archives (POSIX and GNU alike) carry their "ustar" magic,
+// which http.DetectContentType doesn't look for
+const tarMagicOffset = 257
+
+// maxMimetypeLength matches the size of the ps_files.mimetype column
+const maxMimetypeLength = 100
+
+// zipContainerTypes are formats that are zip archives on the wire but have a more specific type
+var zipContainerTypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".epub": "application/epub+zip",
+	".jar":  "application/java-archive",
+	".apk":  "application/vnd.android.package-archive",
+}
+
+// DetectMimetype determines a file's type from its leading bytes, only falling back
+// to the (sanitised) filename extension when the content itself is not recognised
+func DetectMimetype(r io.Reader, filename string) (string, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	detected := http.DetectContentType(head[:n])
+	if n >= tarMagicOffset+5 && string(head[tarMagicOffset:tarMagicOffset+5]) == "ustar" {
+		detected = "application/x-tar"
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+
+	switch BaseMimetype(detected) {
+	case "application/zip":
+		if containerType, ok := zipContainerTypes[ext]; ok {
+			detected = containerType
+		}
+	case "application/octet-stream":
+		if byExt := mime.TypeByExtension(ext); byExt != "" && !isTextual(byExt) {
+			detected = byExt
+		}
+	}
+
+	if len(detected) > maxMimetypeLength {
+		detected = BaseMimetype(detected)
+	}
+	return detected, nil
+}
+
+// BaseMimetype strips any parameters (such as charset) from a mimetype
+func BaseMimetype(mimetype string) string {
+	if base, _, err := mime.ParseMediaType(mimetype); err == nil {
+		return base
+	}
+	base, _, _ := strings.Cut(mimetype, ";")
+	return strings.ToLower(strings.TrimSpace(base))
+}
+
+// isTextual reports whether a mimetype would be rendered as text or markup by a browser.
+// Binary content must never be relabelled as one of these based on its extension alone.
+func isTextual(mimetype string) bool {
+	base := BaseMimetype(mimetype)
+	return strings.HasPrefix(base, "text/") || strings.Contains(base, "html") ||
+		strings.Contains(base, "xml") || strings.Contains(base, "javascript") || base == "image/svg+xml"
+}
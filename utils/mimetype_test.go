@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDetectMimetype(t *testing.T) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	tw.WriteHeader(&tar.Header{Name: "notes.txt", Size: 5, Mode: 0o644, Typeflag: tar.TypeReg})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	var gnuTarball bytes.Buffer
+	tw = tar.NewWriter(&gnuTarball)
+	tw.WriteHeader(&tar.Header{Name: "notes.txt", Size: 5, Mode: 0o644, Typeflag: tar.TypeReg, Format: tar.FormatGNU})
+	tw.Write([]byte("hello"))
+	tw.Close()
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	w, _ := zw.Create("notes.txt")
+	w.Write([]byte("hello"))
+	zw.Close()
+
+	pdf := []byte("%PDF-1.7\n")
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	binary := []byte{0x00, 0x01, 0x02, 0x03}
+
+	tests := []struct {
+		name     string
+		content  []byte
+		filename string
+		want     string
+	}{
+		{"pdf", pdf, "doc.pdf", "application/pdf"},
+		{"png named as text", png, "image.txt", "image/png"},
+		{"plain text", []byte("hello world"), "notes.txt", "text/plain; charset=utf-8"},
+		{"html", []byte("<!DOCTYPE html><html></html>"), "page.txt", "text/html; charset=utf-8"},
+		{"tar", tarball.Bytes(), "archive.tar", "application/x-tar"},
+		{"gnu tar", gnuTarball.Bytes(), "archive", "application/x-tar"},
+		{"tar without extension", tarball.Bytes(), "backup", "application/x-tar"},
+		{"zip", archive.Bytes(), "archive.zip", "application/zip"},
+		{"docx", archive.Bytes(), "letter.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"binary with known extension", binary, "scan.pdf", "application/pdf"},
+		{"binary never relabelled as markup", binary, "page.html", "application/octet-stream"},
+		{"binary with unknown extension", binary, "data.unknownext", "application/octet-stream"},
+		{"short file", []byte("ustar"), "x", "text/plain; charset=utf-8"},
+		{"empty", nil, "empty", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DetectMimetype(bytes.NewReader(tt.content), tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("DetectMimetype(%s) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBaseMimetype(t *testing.T) {
+	tests := map[string]string{
+		"text/plain; charset=utf-8": "text/plain",
+		"Application/PDF":           "application/pdf",
+		"image/png":                 "image/png",
+		"not a; valid=\"type":       "not a",
+		"":                          "",
+	}
+	for in, want := range tests {
+		if got := BaseMimetype(in); got != want {
+			t.Errorf("BaseMimetype(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestIsTextual(t *testing.T) {
+	for _, mimetype := range []string{"text/plain", "text/html; charset=utf-8", "application/xhtml+xml", "image/svg+xml", "application/javascript"} {
+		if !isTextual(mimetype) {
+			t.Errorf("isTextual(%q) = false, want true", mimetype)
+		}
+	}
+	for _, mimetype := range []string{"image/png", "application/pdf", strings.ToUpper("audio/mpeg")} {
+		if isTextual(mimetype) {
+			t.Errorf("isTextual(%q) = true, want false", mimetype)
+		}
+	}
+}
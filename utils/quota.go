@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"log"
+	"log/slog"
 	"time"
 
 	"planarcomputer/pss-fs/database"
@@ -24,7 +24,7 @@ func UpdateUserQuota(userID uuid.UUID) error {
 	`, userID).Scan(&totalUsedBytes)
 
 	if result.Error != nil {
-		log.Printf("Error calculating quota for user %s: %v", userID, result.Error)
+		slog.Error("Failed to calculate quota", "user_id", userID, "error", result.Error)
 		return result.Error
 	}
 
@@ -42,11 +42,11 @@ func UpdateUserQuota(userID uuid.UUID) error {
 	`, userID, totalUsedMB, time.Now())
 
 	if result.Error != nil {
-		log.Printf("Error updating quota for user %s: %v", userID, result.Error)
+		slog.Error("Failed to update quota", "user_id", userID, "error", result.Error)
 		return result.Error
 	}
 
-	log.Printf("Updated quota for user %s: %d MB (%d bytes)", userID, totalUsedMB, totalUsedBytes)
+	slog.Debug("Updated quota", "user_id", userID, "bytes", totalUsedBytes)
 	return nil
 }
 
@@ -56,7 +56,7 @@ func UpdateUserQuotaByShareID(shareID uuid.UUID) error {
 	var share models.PsShares
 	result := database.DB.Select("user_id").Where("id = ?", shareID).First(&share)
 	if result.Error != nil {
-		log.Printf("Error finding share %s: %v", shareID, result.Error)
+		slog.Error("Failed to find share for quota update", "share_id", shareID, "error", result.Error)
 		return result.Error
 	}
 
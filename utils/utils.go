@@ -7,3 +7,12 @@ func GetStringPtr(s string) *string {
 	}
 	return &s
 }
+
+// TruncateString shortens s to at most n characters so it fits a varchar(n) column
+func TruncateString(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}